@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Redis Key prefix, api-rate-limit:<endpoint>
+	APIRateLimitPrefix = "api-rate-limit:"
+
+	EndpointStatusesLookup = "statuses/lookup"
+	EndpointStatusesShow   = "statuses/show"
+
+	// apiRateLimitWindow はレスポンスヘッダーにリセットの時間が含まれていない場合に使う制限の期間です。
+	apiRateLimitWindow = 15 * time.Minute
+)
+
+// APIBudget はTwitter APIのエンドポイントごとの残りの呼び出し回数です。
+type APIBudget struct {
+	Remaining int
+	// Reset は残りの回数が回復する時間です。ゼロの場合は残りの回数が分かっていません。
+	Reset time.Time
+}
+
+// Known はレスポンスヘッダーから残りの回数が分かっているかを返します。
+func (b APIBudget) Known() bool {
+	return !b.Reset.IsZero()
+}
+
+// Exhausted は now の時点で残りの回数がないかを返します。
+func (b APIBudget) Exhausted(now time.Time) bool {
+	return b.Known() && b.Remaining <= 0 && now.Before(b.Reset)
+}
+
+// pace は残りの回数をリセットまで均等に使うための呼び出しの間隔を返します。
+func (b APIBudget) pace(now time.Time) time.Duration {
+	if !b.Known() {
+		return 0
+	}
+	until := b.Reset.Sub(now)
+	if b.Remaining <= 0 {
+		return until
+	}
+	return until / time.Duration(b.Remaining)
+}
+
+// apiBudgets はエンドポイントごとの残りの呼び出し回数を記録します。
+// 残りの回数とリセットの時間を "remaining:reset" の形式で、リセットの時間まで保存します。
+type apiBudgets struct {
+	state StateStore
+}
+
+func newAPIBudgets(state StateStore) *apiBudgets {
+	return &apiBudgets{state: state}
+}
+
+// Get はエンドポイントの残りの呼び出し回数を返します。リセットの時間を過ぎている場合は分かっていないものとして扱います。
+func (a *apiBudgets) Get(endpoint string, now time.Time) (APIBudget, error) {
+	var budget APIBudget
+	value, err := a.state.Get(APIRateLimitPrefix + endpoint)
+	if err == ErrStateNotFound {
+		return budget, nil
+	} else if err != nil {
+		return budget, err
+	}
+
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		remaining, err1 := strconv.Atoi(value[:i])
+		reset, err2 := strconv.ParseInt(value[i+1:], 10, 64)
+		if err1 == nil && err2 == nil {
+			budget = APIBudget{Remaining: remaining, Reset: time.Unix(reset, 0)}
+		}
+	}
+
+	if budget.Known() && !now.Before(budget.Reset) {
+		return APIBudget{}, nil
+	}
+	return budget, nil
+}
+
+// Record はレスポンスヘッダーの x-rate-limit-remaining と x-rate-limit-reset を記録します。
+// ヘッダーが含まれていない場合は何もしません。
+func (a *apiBudgets) Record(endpoint string, resp *http.Response, now time.Time) error {
+	if resp == nil {
+		return nil
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("x-rate-limit-remaining"))
+	if err != nil {
+		return nil
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return a.set(endpoint, APIBudget{Remaining: remaining, Reset: time.Unix(reset, 0)}, now)
+}
+
+// Exhaust はエンドポイントの制限を超えたことを記録します。
+// レスポンスヘッダーにリセットの時間が含まれていない場合は now から apiRateLimitWindow の間制限されたものとして扱います。
+func (a *apiBudgets) Exhaust(endpoint string, resp *http.Response, now time.Time) error {
+	reset := now.Add(apiRateLimitWindow)
+	if resp != nil {
+		if r, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64); err == nil {
+			reset = time.Unix(r, 0)
+		}
+	}
+	return a.set(endpoint, APIBudget{Remaining: 0, Reset: reset}, now)
+}
+
+func (a *apiBudgets) set(endpoint string, budget APIBudget, now time.Time) error {
+	ttl := budget.Reset.Sub(now)
+	if ttl <= 0 {
+		return a.state.Del(APIRateLimitPrefix + endpoint)
+	}
+	value := strconv.Itoa(budget.Remaining) + ":" + strconv.FormatInt(budget.Reset.Unix(), 10)
+	return a.state.Set(APIRateLimitPrefix+endpoint, value, ttl)
+}
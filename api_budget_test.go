@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIBudgets(t *testing.T) {
+	clock := newTestClock()
+	budgets := newAPIBudgets(NewMemoryStateStore(clock.now))
+	reset := clock.now().Add(5 * time.Minute)
+
+	if err := budgets.Record(EndpointStatusesLookup, testRateLimitResponse(10, reset), clock.now()); err != nil {
+		t.Fatal(err)
+	}
+	budget, err := budgets.Get(EndpointStatusesLookup, clock.now())
+	if err != nil || budget.Remaining != 10 || !budget.Reset.Equal(reset) {
+		t.Errorf("Get after Record = %+v, %v", budget, err)
+	}
+	if budget.Exhausted(clock.now()) {
+		t.Error("Exhausted with remaining calls")
+	}
+
+	// ヘッダーにリセットの時間が無い場合は、now から apiRateLimitWindow の間制限されます。
+	if err := budgets.Exhaust(EndpointStatusesShow, fakeResponse(429), clock.now()); err != nil {
+		t.Fatal(err)
+	}
+	budget, err = budgets.Get(EndpointStatusesShow, clock.now())
+	if err != nil || !budget.Exhausted(clock.now()) || !budget.Reset.Equal(clock.now().Add(apiRateLimitWindow)) {
+		t.Errorf("Get after Exhaust = %+v, %v", budget, err)
+	}
+
+	clock.advance(5 * time.Minute)
+	if budget, err := budgets.Get(EndpointStatusesLookup, clock.now()); err != nil || budget.Known() {
+		t.Errorf("Get after reset = %+v, %v, want unknown", budget, err)
+	}
+	if budget, _ := budgets.Get(EndpointStatusesShow, clock.now()); !budget.Exhausted(clock.now()) {
+		t.Errorf("Get before the window passes = %+v, want exhausted", budget)
+	}
+
+	// 既にリセットの時間を過ぎている記録は削除します。
+	if err := budgets.Record(EndpointStatusesShow, testRateLimitResponse(0, clock.now().Add(-time.Second)), clock.now()); err != nil {
+		t.Fatal(err)
+	}
+	if budget, err := budgets.Get(EndpointStatusesShow, clock.now()); err != nil || budget.Known() {
+		t.Errorf("Get after recording a past reset = %+v, %v, want unknown", budget, err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dghubble/oauth1"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// Bot はBotの動作に必要な設定と外部サービスのクライアントをすべて保持します。
+// パッケージ変数を持たないため、一つのプロセスで複数のBotを動かすことができます。
+type Bot struct {
+	// config は Config で、deniedClients は isDeniedClient で読み込まれ、再読み込みで置き換えられます。
+	config        atomic.Value // Config
+	deniedClients atomic.Value // []string
+
+	// ID と ScreenName はログインしているBotのアカウントです。
+	ID         int64
+	ScreenName string
+
+	Twitter TwitterAPI
+	// Downloads はダウンロードできるようにした動画の保存先です。
+	// nil の場合、download コマンドは利用できないことを返信し、ダウンロードのAPIは503を返します。
+	Downloads DownloadStore
+	Redis     *redis.Client
+	// State はツイートの制限やおみくじなどの状態の保存先です。Redisを使っていない場合はメモリ上に保存します。
+	State StateStore
+
+	// now は状態の期限やおみくじの日付の判断に使う現在の時刻です。
+	now func() time.Time
+
+	commands     *CommandRegistry
+	profile      *profileStatus
+	lookupQueue  *lookupQueue
+	outbound     OutboundQueue
+	outboundWake chan struct{}
+	// tweets は直近24時間に送信したツイートの記録です。
+	tweets tweetLog
+	// rateLimits はコマンドの実行回数の制限です。
+	rateLimits rateLimiter
+
+	// stopListening は終了を始めたときに閉じられ、Webhookのイベントの受け付けを止めます。
+	stopListening chan struct{}
+	listenDone    chan struct{}
+	// quit は実行中のコマンドが終わったときに閉じられ、キューの処理を止めます。
+	quit chan struct{}
+	// commandsRunning は実行中のコマンド、workers はキューなどを処理しているゴルーチンです。
+	commandsRunning sync.WaitGroup
+	workers         sync.WaitGroup
+}
+
+// Dependencies はBotが利用する外部サービスのクライアントです。
+type Dependencies struct {
+	Twitter   TwitterAPI
+	Downloads DownloadStore
+	// Redis が nil の場合は、送信キューやコマンドの実行回数の制限などをメモリ上に保存します。
+	Redis *redis.Client
+	// State が nil の場合は、Redis があればRedisに、なければメモリ上に保存します。
+	State StateStore
+	// Now が nil の場合は time.Now を使います。
+	Now func() time.Time
+}
+
+// Connect は設定を元に本番用のクライアントを作成します。
+func Connect(config Config) (Dependencies, error) {
+	db, driver, err := openDB(config)
+	if err != nil {
+		return Dependencies{}, err
+	}
+	if config.Database.AutoMigrate {
+		done, err := MigrateUp(db, driver)
+		for _, state := range done {
+			logger.WithField("version", state.Version).WithField("name", state.Name).Info("Applied migration")
+		}
+		if err != nil {
+			db.Close()
+			return Dependencies{}, err
+		}
+	}
+	downloads, err := newDownloadStore(driver, db)
+	if err != nil {
+		db.Close()
+		return Dependencies{}, err
+	}
+
+	// With the memory state driver the bot runs without Redis, so NewBot falls back to in-memory implementations.
+	var redisClient *redis.Client
+	if config.State.Driver != StateDriverMemory {
+		redisClient = redis.NewClient(&redis.Options{
+			Network:  "unix",
+			DB:       config.Redis.DB,
+			Addr:     config.Redis.Addr,
+			Password: config.Redis.Password,
+		})
+	}
+
+	oauthConfig := oauth1.NewConfig(config.Twitter.ConsumerKey, config.Twitter.ConsumerSecret)
+	token := oauth1.NewToken(config.Twitter.AccessToken, config.Twitter.AccessTokenSecret)
+
+	return Dependencies{
+		Twitter:   NewTwitterClient(oauthConfig.Client(oauth1.NoContext, token)),
+		Downloads: downloads,
+		Redis:     redisClient,
+	}, nil
+}
+
+// NewBot は設定とクライアントからBotを作成します。
+// ログインしているアカウントを知るために VerifyCredentials を呼びます。
+func NewBot(config Config, deps Dependencies) (*Bot, error) {
+	if deps.Twitter == nil {
+		return nil, errors.New("twitter client is required")
+	}
+
+	user, _, err := deps.Twitter.VerifyCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	commands := NewCommandRegistry()
+	for _, command := range defaultCommands() {
+		if err := commands.Register(command); err != nil {
+			return nil, err
+		}
+	}
+
+	now := deps.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	outbound := NewMemoryOutboundQueue()
+	tweets := newMemoryTweetLog()
+	rateLimits := newMemoryRateLimiter()
+	state := deps.State
+	if deps.Redis != nil {
+		outbound = NewRedisOutboundQueue(deps.Redis)
+		tweets = newRedisTweetLog(deps.Redis)
+		rateLimits = newRedisRateLimiter(deps.Redis)
+		if state == nil {
+			state = NewRedisStateStore(deps.Redis)
+		}
+	}
+	if state == nil {
+		state = NewMemoryStateStore(now)
+	}
+
+	b := &Bot{
+		ID:           user.ID,
+		ScreenName:   user.ScreenName,
+		Twitter:      deps.Twitter,
+		Downloads:    deps.Downloads,
+		Redis:        deps.Redis,
+		State:        state,
+		now:          now,
+		commands:     commands,
+		profile:      newProfileStatus(config, deps.Twitter, state, user),
+		lookupQueue:  NewLookupQueue(deps.Twitter, state, newTweetCache(config, deps.Redis)),
+		outbound:     outbound,
+		outboundWake: make(chan struct{}, 1),
+		tweets:       tweets,
+		rateLimits:   rateLimits,
+
+		stopListening: make(chan struct{}),
+		quit:          make(chan struct{}),
+	}
+	b.config.Store(config)
+	b.deniedClients.Store([]string(nil))
+	return b, nil
+}
+
+// Config は現在の設定を返します。設定は再読み込みで置き換えられるため、保持せずに毎回呼び出してください。
+func (b *Bot) Config() Config {
+	return b.config.Load().(Config)
+}
+
+// Start はツイートの検索キューとメッセージの送信キューの処理を開始します。
+func (b *Bot) Start() {
+	b.profile.Set(ProfileMaintenance, b.Config().Maintenance)
+	b.profile.Set(ProfileRateLimited, b.isReplyBlocked())
+	b.profile.Set(ProfileRestricted, b.IsTimeRestricting())
+	b.workers.Add(3)
+	go func() {
+		defer b.workers.Done()
+		b.profile.run(b.quit, b.IsTimeRestricting, b.isReplyBlocked)
+	}()
+	go func() {
+		defer b.workers.Done()
+		b.lookupQueue.Run(b.quit)
+	}()
+	go func() {
+		defer b.workers.Done()
+		b.MessageSendTicker()
+	}()
+}
+
+// Close はデータベースとRedisとの接続を閉じます。
+func (b *Bot) Close() {
+	if b.Downloads != nil {
+		_ = b.Downloads.Close()
+	}
+	if b.Redis != nil {
+		_ = b.Redis.Close()
+	}
+}
+
+// LoadDeniedClientList は path から拒否するクライアントの一覧を読み込みます。
+// ファイルが存在しない場合は作成します。
+func (b *Bot) LoadDeniedClientList(path string) error {
+	fp, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var deniedClients []string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") { // Comment
+			continue
+		}
+		deniedClients = append(deniedClients, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	old := b.DeniedClients()
+	b.deniedClients.Store(deniedClients)
+	if added, removed := diffStrings(old, deniedClients); len(added) > 0 || len(removed) > 0 {
+		logger.WithFields(logrus.Fields{
+			"path":    path,
+			"added":   added,
+			"removed": removed,
+		}).Info("Loaded denied clients")
+	}
+	return nil
+}
+
+// DeniedClients は拒否しているクライアントの一覧を返します。
+func (b *Bot) DeniedClients() []string {
+	return b.deniedClients.Load().([]string)
+}
+
+func (b *Bot) isDeniedClient(via string) bool {
+	for _, v := range b.DeniedClients() {
+		if v == via {
+			return true
+		}
+	}
+	return false
+}
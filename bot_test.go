@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// testClock はテストで進める時刻です。Botのゴルーチンからも読まれるため、ロックして扱います。
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Date(2020, 5, 24, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// testUser はテストでコマンドを送信するユーザーです。
+var testUser = twitter.User{ID: 2000, IDStr: "2000", Name: "tomo", ScreenName: "tomocrafter"}
+
+// newTestBot は fake と clock を使うBotを作成します。Redisは使わず、ダウンロードは :memory: のSQLiteに保存します。
+func newTestBot(t *testing.T, config Config, fake *FakeTwitterClient, clock *testClock) *Bot {
+	t.Helper()
+	bot, err := NewBot(config, Dependencies{Twitter: fake, Downloads: newTestDownloadStore(t), Now: clock.now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+// startTestBot は bot のキューの処理を開始し、テストの終わりに止めます。
+func startTestBot(t *testing.T, bot *Bot) {
+	t.Helper()
+	bot.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := bot.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+}
+
+// testDirectMessage は testUser から bot へのダイレクトメッセージです。
+func testDirectMessage(bot *Bot, text string, urls ...twitter.URLEntity) DirectMessageSender {
+	user := testUser
+	return DirectMessageSender{
+		Bot:  bot,
+		User: &user,
+		DirectMessageEvent: &twitter.DirectMessageEvent{
+			ID:   "3000",
+			Type: "message_create",
+			Message: &twitter.DirectMessageEventMessage{
+				SenderID: user.IDStr,
+				Target:   &twitter.DirectMessageTarget{RecipientID: replayBotUser.IDStr},
+				Data:     &twitter.DirectMessageData{Text: text, Entities: &twitter.Entities{Urls: urls}},
+			},
+		},
+	}
+}
+
+// testMention は testUser から bot へのリプライです。
+func testMention(bot *Bot, id, inReplyTo int64) TimelineSender {
+	user := testUser
+	return TimelineSender{
+		Bot: bot,
+		Tweet: &twitter.Tweet{
+			ID:                id,
+			IDStr:             strconv.FormatInt(id, 10),
+			Text:              "@" + replayBotUser.ScreenName,
+			InReplyToStatusID: inReplyTo,
+			User:              &user,
+		},
+	}
+}
+
+func TestShutdownWhileRepliesBlocked(t *testing.T) {
+	clock := newTestClock()
+	bot := newTestBot(t, Config{}, NewFakeTwitterClient(replayBotUser), clock)
+	bot.blockReplies(clock.now().Add(time.Hour))
+	bot.Start()
+	// 送信のゴルーチンが制限の解除を待ち始めるまで待ちます。
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bot.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Errorf("Shutdown took %s while replies were blocked", d)
+	}
+}
+
+func TestIsTimeRestricting(t *testing.T) {
+	tests := []struct {
+		hour, minute int
+		want         bool
+	}{
+		{3, 29, false},
+		{3, 30, true},
+		{3, 34, true},
+		{3, 40, true},
+		{3, 41, false},
+		{15, 34, false},
+	}
+	for _, tt := range tests {
+		clock := &testClock{t: time.Date(2020, 5, 24, tt.hour, tt.minute, 0, 0, location)}
+		bot := newTestBot(t, Config{}, NewFakeTwitterClient(replayBotUser), clock)
+		if got := bot.IsTimeRestricting(); got != tt.want {
+			t.Errorf("IsTimeRestricting at %02d:%02d = %v, want %v", tt.hour, tt.minute, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadsDisabled(t *testing.T) {
+	var config Config
+	config.Path.Webhook = "/webhook"
+	fake := NewFakeTwitterClient(replayBotUser)
+	bot, err := NewBot(config, Dependencies{Twitter: fake, Now: newTestClock().now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := bot.NewRouter()
+	startTestBot(t, bot)
+
+	for _, path := range []string{"/api/downloads/tomocrafter", "/api/suggests?query=tomo"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != "[]" {
+			t.Errorf("GET %s = %d %s, want 503 []", path, w.Code, w.Body)
+		}
+	}
+
+	bot.Dispatch(testDirectMessage(bot, "download 123"), "download 123")
+	if messages := messageTexts(fake.SentDirectMessages()); len(messages) != 1 || messages[0] != "現在、ダウンロード機能は利用できません。" {
+		t.Errorf("sent %q, want the download command unavailable", messages)
+	}
+}
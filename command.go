@@ -2,28 +2,175 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"unicode"
 
 	"github.com/getsentry/sentry-go"
 )
 
-var handlers = map[string]Executor{
-	"time": timeCommand,
+type Executor func(bot *Bot, sender CommandSender, args *Args)
 
-	"download": downloadCommand,
-	"dl":       downloadCommand,
+// SenderType はコマンドを受け付ける送信元の種類です。
+type SenderType int
 
-	"roll": RollCommand,
+const (
+	SenderTimeline SenderType = 1 << iota
+	SenderDirectMessage
 
-	"omikuji": OmikujiCommand,
-	"おみくじ":    OmikujiCommand,
-	"おみくじ🎰":   OmikujiCommand,
+	SenderAll = SenderTimeline | SenderDirectMessage
+)
+
+func senderTypeOf(s CommandSender) SenderType {
+	switch s.(type) {
+	case TimelineSender:
+		return SenderTimeline
+	case DirectMessageSender:
+		return SenderDirectMessage
+	}
+	return 0
+}
+
+// Command はコマンドの情報と、その処理をまとめたものです。
+type Command struct {
+	Name        string
+	Aliases     []string
+	Description string
+	// Usage はコマンド名を除いた引数の説明です。
+	Usage string
+	// Args は受け付ける引数の定義です。引数の数が合う最初の定義でパースされます。
+	Args  []ArgSpec
+	Flags []Flag
+	// Senders はこのコマンドを受け付ける送信元です。
+	Senders SenderType
+	// Enabled は設定の commands で指定されていない場合に、コマンドが有効かです。
+	Enabled  bool
+	Executor Executor
+}
+
+// Accepts は送信元 s からの実行を受け付けるかを返します。コマンドが有効かは Config.CommandEnabled で確かめてください。
+func (c *Command) Accepts(s CommandSender) bool {
+	return c.Senders&senderTypeOf(s) != 0
+}
+
+func (c *Command) findFlag(name string) (Flag, bool) {
+	for _, flag := range c.Flags {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return Flag{}, false
+}
+
+// CommandRegistry はコマンド名とエイリアスからコマンドを検索します。
+type CommandRegistry struct {
+	commands []*Command
+	labels   map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		labels: make(map[string]*Command),
+	}
 }
 
-type Executor func(sender CommandSender, args []string)
+// Register はコマンドを登録します。名前かエイリアスがすでに登録されている場合はエラーを返します。
+func (r *CommandRegistry) Register(c *Command) error {
+	labels := append([]string{c.Name}, c.Aliases...)
+	for _, label := range labels {
+		if _, ok := r.labels[strings.ToLower(label)]; ok {
+			return fmt.Errorf("command label %q is already registered", label)
+		}
+	}
+	for _, label := range labels {
+		r.labels[strings.ToLower(label)] = c
+	}
+	r.commands = append(r.commands, c)
+	return nil
+}
+
+// Lookup は名前かエイリアスが label のコマンドを返します。
+func (r *CommandRegistry) Lookup(label string) (*Command, bool) {
+	c, ok := r.labels[label]
+	return c, ok
+}
+
+// Commands は登録された順にコマンドを返します。
+func (r *CommandRegistry) Commands() []*Command {
+	return r.commands
+}
+
+// defaultCommands はBotに標準で登録されるコマンドです。
+func defaultCommands() []*Command {
+	return []*Command{
+		{
+			Name:        "time",
+			Description: "ツイートされた時間をミリ秒単位で表示します。",
+			Usage:       "(リプライ) / DM: [--date] <ツイートのURLかID>...",
+			Args: []ArgSpec{
+				{Senders: SenderDirectMessage, Args: []Arg{
+					{Name: "tweets", Label: "ツイート", Type: ArgTweet, Variadic: true},
+				}},
+			},
+			Flags: []Flag{
+				{Name: "date", Description: "日付も表示します。"},
+			},
+			Senders:  SenderAll,
+			Enabled:  true,
+			Executor: timeCommand,
+		},
+		{
+			Name:        "download",
+			Aliases:     []string{"dl"},
+			Description: "動画やgifをダウンロードできるようにします。DMではダウンロード履歴から削除します。",
+			Usage:       "(動画へのリプライ) / DM: <ツイートID>",
+			Args: []ArgSpec{
+				{Senders: SenderDirectMessage, Args: []Arg{
+					{Name: "tweet", Label: "ツイートID", Type: ArgTweet},
+				}},
+			},
+			Senders:  SenderAll,
+			Enabled:  true,
+			Executor: downloadCommand,
+		},
+		{
+			Name:        "roll",
+			Description: "1から指定した数までのランダムな数か、指定した要素から一つを選びます。",
+			Usage:       "[最大値 | 要素...]",
+			Args: []ArgSpec{
+				{},
+				{Args: []Arg{{Name: "max", Label: "最大値", Type: ArgInt, Min: 2, Max: math.MaxInt32}}},
+				{Args: []Arg{{Name: "choices", Label: "要素", Type: ArgText, Variadic: true}}},
+			},
+			Senders:  SenderAll,
+			Enabled:  true,
+			Executor: RollCommand,
+		},
+		{
+			Name:        "omikuji",
+			Aliases:     []string{"おみくじ", "おみくじ🎰"},
+			Description: "おみくじを引きます。1/1から1/7まで、1日1回利用できます。",
+			Senders:     SenderAll,
+			Enabled:     true,
+			Executor:    OmikujiCommand,
+		},
+		{
+			Name:        "help",
+			Aliases:     []string{"ヘルプ"},
+			Description: "コマンドの一覧を表示します。",
+			Usage:       "[コマンド名]",
+			Args: []ArgSpec{
+				{Args: []Arg{{Name: "command", Label: "コマンド名", Type: ArgText, Optional: true}}},
+			},
+			Senders:  SenderAll,
+			Enabled:  true,
+			Executor: helpCommand,
+		},
+	}
+}
 
 func isBlank(str string) bool {
 	for _, char := range str {
@@ -34,62 +181,171 @@ func isBlank(str string) bool {
 	return true
 }
 
-func parseCommand(c string) (string, []string) {
+func parseCommand(c string) (string, []argToken) {
 	if isBlank(c) {
-		return "", []string{}
+		return "", []argToken{}
 	}
 
-	split := strings.Fields(c)
+	tokens := tokenize(c)
 
-	return strings.ToLower(split[0]), split[1:]
+	return strings.ToLower(tokens[0].value), tokens[1:]
+}
+
+// withSentryHub は hub を送信元の情報でタグ付けし、s に設定します。
+func withSentryHub(s CommandSender, hub *sentry.Hub) CommandSender {
+	scope := hub.Scope()
+	scope.SetTag("sender", senderTypeOf(s).String())
+	if id := correlationID(s.Logger()); id != "" {
+		scope.SetTag("correlation_id", id)
+	}
+	if ts, ok := s.(TwitterSender); ok {
+		scope.SetTag("user_id", strconv.FormatInt(ts.GetUserId(), 10))
+		scope.SetTag("screen_name", ts.GetScreenName())
+		scope.SetUser(sentry.User{ID: strconv.FormatInt(ts.GetUserId(), 10), Username: ts.GetScreenName()})
+	}
+
+	switch t := s.(type) {
+	case TimelineSender:
+		scope.SetTag("tweet_id", strconv.FormatInt(t.Tweet.ID, 10))
+		if t.Tweet.InReplyToStatusID != 0 {
+			scope.SetTag("in_reply_to_status_id", strconv.FormatInt(t.Tweet.InReplyToStatusID, 10))
+		}
+		t.Hub = hub
+		return t
+	case DirectMessageSender:
+		if t.DirectMessageEvent != nil {
+			scope.SetTag("dm_id", t.DirectMessageEvent.ID)
+		}
+		t.Hub = hub
+		return t
+	}
+	return s
 }
 
 // Dispatch executes command that passed by webhook listener,
 // Blocking will occurs if tweet need to be looked up.
 // and then execute command in blocking.
-func Dispatch(s CommandSender, c string) {
+func (b *Bot) Dispatch(s CommandSender, c string) {
 	c = strings.TrimSpace(c)
 	label, args := parseCommand(c)
 
 	// TODO: DM Handle Practice
 
+	// Every event reported while executing this command carries who sent which command.
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTag("command_label", label)
+	s = withSentryHub(s, hub)
+
 	defer func() {
 		if r := recover(); r != nil {
 			err := fmt.Errorf("panic recovered: %v\n%s", r, string(debug.Stack()))
-			fmt.Printf("Panicking on executing command: %+v\n", err)
-			sentry.CaptureException(err)
+			s.Logger().WithError(err).Error("Panicking on executing command")
+			hub.CaptureException(err)
 		}
 	}()
 
-	var command Executor
-
+	// The command is resolved without looking up any tweet, so that the rate limit is taken before the API is used.
+	var command *Command
+	// needsLookup is set when an empty reply is the download command only if the replied tweet has a video.
+	// The limit of download is taken for it even if it turns out to be the time command.
+	needsLookup := false
 	if label == "" {
 		if tl, ok := s.(TimelineSender); ok {
-			replyID := tl.Tweet.InReplyToStatusID
-			if replyID != 0 {
-				tweet := queueProcessor.LookupTweetBlocking(replyID)
-				if _, err := GetVideoVariant(&tweet); err == nil { // If target tweet has downloadable media
-					tl.ReplyCache = &tweet
-					command = downloadCommand
-				} else {
-					command = timeCommand
-				}
+			download, _ := b.commands.Lookup("download")
+			if tl.Tweet.InReplyToStatusID != 0 && download != nil && b.Config().CommandEnabled(download) {
+				command, needsLookup = download, true
 			} else {
-				command = timeCommand
+				command, _ = b.commands.Lookup("time")
 			}
+		} else if _, ok := s.(DirectMessageSender); ok {
+			// An empty direct message gets the list of commands.
+			command, _ = b.commands.Lookup("help")
 		} else {
-			fmt.Println("non timeline sender sent empty command: ", reflect.TypeOf(s))
+			s.Logger().WithField("sender", reflect.TypeOf(s).String()).Warn("non timeline sender sent empty command")
 		}
 	} else {
-		command = handlers[label]
+		command, _ = b.commands.Lookup(label)
+	}
+	if command != nil && !b.Config().CommandEnabled(command) { // Disabled commands are treated as unknown
+		command = nil
+	}
+
+	// Unknown commands are answered only in direct messages, with the time of the tweet if only its URL was sent.
+	dm, isDM := s.(DirectMessageSender)
+	quickTimeID, isQuickTime := int64(0), false
+	rateLimitName := ""
+	switch {
+	case command != nil:
+		rateLimitName = command.Name
+	case isDM && label != "":
+		if quickTimeID, isQuickTime = quickTimeTweetID(dm); isQuickTime {
+			rateLimitName = "time"
+		} else {
+			rateLimitName = unknownCommandRateLimit
+		}
+	default:
+		return
+	}
+
+	if ts, ok := s.(TwitterSender); ok {
+		allowed, notify, retryAfter := b.takeRateLimit(rateLimitName, ts.GetUserId())
+		if !allowed {
+			if notify {
+				s.SendNotice(rateLimitedMessage(retryAfter))
+			}
+			return
+		}
+	}
+
+	if command == nil {
+		if isQuickTime {
+			quickTime(dm, quickTimeID)
+		} else {
+			dm.SendMessage("「" + label + "」というコマンドは存在しません。help と送信するとコマンドの一覧を確認できます。")
+		}
+		return
+	}
+
+	if needsLookup {
+		tl := s.(TimelineSender)
+		tweet, err := b.lookupTweet(hub, tl.Tweet.InReplyToStatusID)
+		if err == nil {
+			_, err = GetVideoVariant(&tweet)
+		}
+		if err == nil { // If target tweet has downloadable media
+			tl.ReplyCache = &tweet
+			s = tl
+		} else {
+			command, _ = b.commands.Lookup("time")
+			if command == nil || !b.Config().CommandEnabled(command) {
+				return
+			}
+		}
+	}
+	hub.Scope().SetTag("command", command.Name)
+
+	if !command.Accepts(s) {
+		if _, ok := s.(DirectMessageSender); ok {
+			s.SendMessage(command.Name + " コマンドはDMでは利用できません。")
+		} else {
+			s.SendMessage(command.Name + " コマンドはリプライでは利用できません。")
+		}
+		return
 	}
 
-	if command == nil { // If unknown command has issued
-		if s, ok := s.(DirectMessageSender); ok { // and If sender is from direct message.
-			handleQuickTime(s)
+	urls := senderURLs(s)
+	parsed, err := parseArgs(command, senderTypeOf(s), args, func(url string) string {
+		if expanded, ok := urls[url]; ok {
+			return expanded
 		}
+		return url
+	})
+	if err != nil {
+		s.SendMessage(err.Error())
 		return
 	}
 
-	command(s, args)
+	commandsDispatched.WithLabelValues(command.Name, senderTypeOf(s).String()).Inc()
+	s.Logger().WithField("command", command.Name).Info("Dispatching command")
+	command.Executor(b, s, parsed)
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ArgType は引数の型です。
+type ArgType int
+
+const (
+	// ArgText は任意の文字列です。
+	ArgText ArgType = iota
+	// ArgInt は Min から Max までの整数です。
+	ArgInt
+	// ArgTweet はツイートのIDかURLです。
+	ArgTweet
+)
+
+// Arg は位置引数の定義です。
+type Arg struct {
+	// Name は Args から値を取り出すときに使う名前です。
+	Name string
+	// Label はエラーメッセージに表示する名前です。空の場合は Name を使います。
+	Label string
+	Type  ArgType
+	// Min と Max は ArgInt の範囲です。両方0の場合は範囲を確かめません。
+	Min, Max int64
+	// Optional な引数は省略することができます。
+	Optional bool
+	// Variadic な引数は残りの引数をすべて受け取ります。最後の引数にのみ指定できます。
+	Variadic bool
+}
+
+func (a Arg) label() string {
+	if a.Label != "" {
+		return a.Label
+	}
+	return a.Name
+}
+
+// ArgSpec はコマンドが受け付ける引数の組み合わせです。
+type ArgSpec struct {
+	// Senders はこの定義を適用する送信元です。0の場合はすべての送信元に適用します。
+	Senders SenderType
+	Args    []Arg
+}
+
+func (s ArgSpec) appliesTo(t SenderType) bool {
+	return s.Senders == 0 || s.Senders&t != 0
+}
+
+// accepts は n 個の位置引数を受け付けるかを返します。
+func (s ArgSpec) accepts(n int) bool {
+	required := 0
+	for _, arg := range s.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	if n < required {
+		return false
+	}
+	if len(s.Args) > 0 && s.Args[len(s.Args)-1].Variadic {
+		return true
+	}
+	return n <= len(s.Args)
+}
+
+// Flag は --name か --name=value の形式で指定するオプションです。
+type Flag struct {
+	Name        string
+	Description string
+	// HasValue が true の場合、--name=value か --name value の形式で値を受け取ります。
+	HasValue bool
+}
+
+// Args はパースされたコマンドの引数です。
+type Args struct {
+	// Raw はフラグを含むすべての引数です。
+	Raw []string
+
+	positional []string
+	values     map[string][]interface{}
+	flags      map[string]string
+}
+
+// Len はフラグを除いた位置引数の数を返します。
+func (a *Args) Len() int {
+	return len(a.positional)
+}
+
+// Positional はフラグを除いた位置引数を返します。
+func (a *Args) Positional() []string {
+	return a.positional
+}
+
+func (a *Args) value(name string) (interface{}, bool) {
+	if v := a.values[name]; len(v) > 0 {
+		return v[0], true
+	}
+	return nil, false
+}
+
+// Int は ArgInt の引数を返します。
+func (a *Args) Int(name string) (int64, bool) {
+	v, ok := a.value(name)
+	if !ok {
+		return 0, false
+	}
+	i, ok := v.(int64)
+	return i, ok
+}
+
+// Tweet は ArgTweet の引数のツイートIDを返します。
+func (a *Args) Tweet(name string) (int64, bool) {
+	return a.Int(name)
+}
+
+// Tweets は Variadic な ArgTweet の引数のツイートIDをすべて返します。
+func (a *Args) Tweets(name string) []int64 {
+	ids := make([]int64, 0, len(a.values[name]))
+	for _, v := range a.values[name] {
+		if id, ok := v.(int64); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Text は ArgText の引数を返します。
+func (a *Args) Text(name string) (string, bool) {
+	v, ok := a.value(name)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// Texts は Variadic な ArgText の引数をすべて返します。
+func (a *Args) Texts(name string) []string {
+	texts := make([]string, 0, len(a.values[name]))
+	for _, v := range a.values[name] {
+		if s, ok := v.(string); ok {
+			texts = append(texts, s)
+		}
+	}
+	return texts
+}
+
+// Flag はフラグが指定されたかを返します。
+func (a *Args) Flag(name string) bool {
+	_, ok := a.flags[name]
+	return ok
+}
+
+// FlagValue はフラグに指定された値を返します。
+func (a *Args) FlagValue(name string) (string, bool) {
+	v, ok := a.flags[name]
+	return v, ok
+}
+
+// argToken は引用符で囲まれていたかを記録した引数です。引用符で囲まれた引数はフラグとして扱いません。
+type argToken struct {
+	value  string
+	quoted bool
+}
+
+// closingQuote は開き引用符に対応する閉じ引用符です。
+var closingQuote = map[rune]rune{
+	'"': '"',
+	'“': '”',
+}
+
+// tokenize は空白で引数を区切ります。"" か “” で囲まれた部分は空白を含めて一つの引数として扱います。
+// 引用符が閉じられていない場合は、残りをすべて一つの引数として扱います。
+func tokenize(s string) []argToken {
+	var tokens []argToken
+	var sb strings.Builder
+	var closing rune
+	inToken, quoted := false, false
+
+	flush := func() {
+		if inToken {
+			tokens = append(tokens, argToken{value: sb.String(), quoted: quoted})
+		}
+		sb.Reset()
+		inToken, quoted = false, false
+	}
+
+	for _, r := range s {
+		switch {
+		case closing != 0:
+			if r == closing {
+				closing = 0
+			} else {
+				sb.WriteRune(r)
+			}
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			if c, ok := closingQuote[r]; ok {
+				closing = c
+				inToken, quoted = true, true
+			} else {
+				sb.WriteRune(r)
+				inToken = true
+			}
+		}
+	}
+	flush()
+	return tokens
+}
+
+// parseArgs は command の定義に従って引数をパースします。
+// 返されるエラーのメッセージはそのまま送信元に返信できる文章です。
+// expandURL は短縮URLを展開するために使われます。
+func parseArgs(command *Command, sender SenderType, tokens []argToken, expandURL func(string) string) (*Args, error) {
+	args := &Args{
+		Raw:    make([]string, len(tokens)),
+		values: make(map[string][]interface{}),
+		flags:  make(map[string]string),
+	}
+	for i, token := range tokens {
+		args.Raw[i] = token.value
+	}
+
+	// Flags
+	endOfFlags := len(command.Flags) == 0
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if endOfFlags || token.quoted || !strings.HasPrefix(token.value, "--") {
+			args.positional = append(args.positional, token.value)
+			continue
+		}
+		if token.value == "--" {
+			endOfFlags = true
+			continue
+		}
+
+		name, value := token.value[2:], ""
+		hasValue := false
+		if n := strings.IndexByte(name, '='); n >= 0 {
+			name, value, hasValue = name[:n], name[n+1:], true
+		}
+		flag, ok := command.findFlag(name)
+		if !ok {
+			return nil, fmt.Errorf("--%s というオプションは存在しません。", name)
+		}
+		if flag.HasValue && !hasValue {
+			if i+1 >= len(tokens) {
+				return nil, fmt.Errorf("--%s には値を指定してください。", name)
+			}
+			i++
+			value = tokens[i].value
+		}
+		args.flags[flag.Name] = value
+	}
+
+	var specs []ArgSpec
+	for _, spec := range command.Args {
+		if spec.appliesTo(sender) {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 { // No argument definition for this sender.
+		return args, nil
+	}
+
+	for _, spec := range specs {
+		if !spec.accepts(len(args.positional)) {
+			continue
+		}
+		for i, raw := range args.positional {
+			arg := spec.Args[len(spec.Args)-1]
+			if i < len(spec.Args) {
+				arg = spec.Args[i]
+			}
+			v, err := parseArg(arg, raw, expandURL)
+			if err != nil {
+				return nil, err
+			}
+			args.values[arg.Name] = append(args.values[arg.Name], v)
+		}
+		return args, nil
+	}
+
+	message := "引数の数が正しくありません。"
+	if command.Usage != "" {
+		message += "\n使い方: " + command.Name + " " + command.Usage
+	}
+	return nil, errors.New(message)
+}
+
+func parseArg(arg Arg, raw string, expandURL func(string) string) (interface{}, error) {
+	switch arg.Type {
+	case ArgInt:
+		rangeCheck := arg.Min != 0 || arg.Max != 0
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || (rangeCheck && (i < arg.Min || i > arg.Max)) {
+			if rangeCheck {
+				return nil, fmt.Errorf("%s には %s から %s までの数値を指定してください。", arg.label(), formatNumber(arg.Min), formatNumber(arg.Max))
+			}
+			return nil, fmt.Errorf("%s には数値を指定してください。", arg.label())
+		}
+		return i, nil
+	case ArgTweet:
+		if id, err := strconv.ParseInt(raw, 10, 64); err == nil && id > 0 {
+			return id, nil
+		}
+		url := raw
+		if expandURL != nil {
+			url = expandURL(raw)
+		}
+		if id, ok := getTweetIDFromURL(url); ok {
+			return id, nil
+		}
+		return nil, errors.New(InvalidArgumentError)
+	default:
+		return raw, nil
+	}
+}
+
+// formatNumber は3桁ごとにカンマで区切った数値を返します。
+func formatNumber(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	var sb strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(r)
+	}
+	return sign + sb.String()
+}
+
+// senderURLs は送信元のツイートやメッセージに含まれる短縮URLと展開後のURLの対応を返します。
+func senderURLs(s CommandSender) map[string]string {
+	urls := make(map[string]string) // Shorten URL -> Expanded URL
+	switch s := s.(type) {
+	case TimelineSender:
+		if s.Tweet.Entities != nil {
+			for _, url := range s.Tweet.Entities.Urls {
+				urls[url.URL] = url.ExpandedURL
+			}
+		}
+	case DirectMessageSender:
+		if s.DirectMessageEvent != nil && s.DirectMessageEvent.Message != nil && s.DirectMessageEvent.Message.Data != nil && s.DirectMessageEvent.Message.Data.Entities != nil {
+			for _, url := range s.DirectMessageEvent.Message.Data.Entities.Urls {
+				urls[url.URL] = url.ExpandedURL
+			}
+		}
+	}
+	return urls
+}
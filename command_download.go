@@ -1,17 +1,25 @@
 package main
 
 import (
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"time"
+	"unicode/utf8"
 
-	"github.com/getsentry/sentry-go"
-	"github.com/go-sql-driver/mysql"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
-func downloadCommand(s CommandSender, args []string) {
+func downloadCommand(b *Bot, s CommandSender, args *Args) {
+	if b.Downloads == nil {
+		s.SendNotice("現在、ダウンロード機能は利用できません。")
+		return
+	}
+
 	switch s := s.(type) {
 	case TimelineSender:
-		if IsTimeRestricting() {
+		if b.IsTimeRestricting() {
 			return
 		}
 
@@ -26,7 +34,12 @@ func downloadCommand(s CommandSender, args []string) {
 		if s.ReplyCache != nil {
 			tweet = *s.ReplyCache
 		} else {
-			tweet = queueProcessor.LookupTweetBlocking(replyID)
+			var err error
+			tweet, err = b.lookupTweet(s.Sentry(), replyID)
+			if err != nil {
+				s.SendMessage(lookupErrorMessage(err))
+				return
+			}
 		}
 
 		variant, err := GetVideoVariant(&tweet)
@@ -35,42 +48,103 @@ func downloadCommand(s CommandSender, args []string) {
 			return
 		}
 
-		e := dbMap.Insert(&Download{
-			ScreenName:     s.Tweet.User.ScreenName,
-			VideoURL:       variant.URL,
-			VideoThumbnail: tweet.ExtendedEntities.Media[0].MediaURLHttps,
-			TweetID:        replyID,
-		})
+		e := b.Downloads.Insert(newDownload(s.Tweet.User, &tweet, variant, b.now()))
 		if e != nil {
-			if mysqlErr, ok := e.(*mysql.MySQLError); ok {
-				// https://dev.mysql.com/doc/refman/8.0/en/server-error-reference.html
-				if mysqlErr.Number == 1062 { // ER_DUP_ENTRY
-					s.SendMessage("この動画/gifはすでに保存済みです。下記URLからダウンロードしてください。\nhttps://bot.tomocraft.net/downloads/" + s.Tweet.User.ScreenName)
-					return
-				}
+			if e == ErrDownloadExists {
+				s.SendMessage("この動画/gifはすでに保存済みです。下記URLからダウンロードしてください。\n" + b.downloadsURL(s.Tweet.User.ScreenName))
+				return
 			}
 			s.SendMessage("@tomocrafter データベース上にてエラーが発生しました。開発者ができる限り早くサポート致します。")
-			sentry.CaptureException(e)
+			s.Logger().WithError(e).Error("Error on inserting download")
+			s.Sentry().CaptureException(e)
 		} else {
-			s.SendMessage("ダウンロードの準備が整いました。下記URLからダウンロードしてください。\nhttps://bot.tomocraft.net/downloads/" + s.Tweet.User.ScreenName)
+			s.SendMessage("ダウンロードの準備が整いました。下記URLからダウンロードしてください。\n" + b.downloadsURL(s.Tweet.User.ScreenName))
 		}
 
 	case DirectMessageSender:
-		if len(args) == 0 {
-			s.SendMessage("削除したい動画/gifのIDを指定してください。")
-			return
+		id, _ := args.Tweet("tweet")
+		deleted, err := b.Downloads.Delete(s.User.ID, s.User.ScreenName, id)
+		if err != nil {
+			s.SendMessage("データベース上にてエラーが発生しました。開発者ができる限り早くサポート致します。")
+			s.Logger().WithError(err).Error("Error on deleting download")
+			s.Sentry().CaptureException(err)
+		} else if deleted {
+			s.SendMessage("削除が完了しました！")
 		}
+	}
+}
 
-		if id, err := strconv.ParseInt(args[0], 10, 64); err != nil {
-			s.SendMessage("TwitterのツイートIDを指定してください。通常、長い数字になるはずです。")
-		} else {
-			count, err := dbMap.Delete(&Download{TweetID: id, ScreenName: s.User.ScreenName})
-			if err != nil {
-				s.SendMessage("データベース上にてエラーが発生しました。開発者ができる限り早くサポート致します。")
-				sentry.CaptureException(err)
-			} else if count > 0 {
-				s.SendMessage("削除が完了しました！")
-			}
+// maxDownloadTextLength は保存するツイートの本文の最大の文字数です。
+const maxDownloadTextLength = 1024
+
+// videoResolution は video.twimg.com のURLに含まれる解像度です。
+var videoResolution = regexp.MustCompile(`/([0-9]+)x([0-9]+)/`)
+
+// newDownload は user が依頼した tweet の動画を保存する Download を作成します。
+// tweet は GetVideoVariant で variant を取り出せたものにしてください。
+func newDownload(user *twitter.User, tweet *twitter.Tweet, variant *twitter.VideoVariant, requestedAt time.Time) Download {
+	media := tweet.ExtendedEntities.Media[0]
+	d := Download{
+		UserID:         user.ID,
+		ScreenName:     user.ScreenName,
+		TweetID:        tweet.ID,
+		Text:           truncateRunes(tweetText(*tweet), maxDownloadTextLength),
+		MediaType:      media.Type,
+		DurationMillis: media.VideoInfo.DurationMillis,
+		VideoURL:       variant.URL,
+		Bitrate:        variant.Bitrate,
+		VideoThumbnail: media.MediaURLHttps,
+		Variants:       mp4Variants(media),
+		RequestedAt:    requestedAt.UTC().Truncate(time.Second),
+	}
+	if tweet.User != nil {
+		d.AuthorID = tweet.User.ID
+		d.AuthorScreenName = tweet.User.ScreenName
+	}
+	return d
+}
+
+// mp4Variants はメディアのMP4をビットレートの高い順に返します。
+func mp4Variants(media twitter.MediaEntity) []DownloadVariant {
+	var variants []DownloadVariant
+	for _, v := range media.VideoInfo.Variants {
+		if v.ContentType != "video/mp4" {
+			continue
 		}
+		variant := DownloadVariant{URL: v.URL, Bitrate: v.Bitrate}
+		if m := videoResolution.FindStringSubmatch(v.URL); m != nil {
+			variant.Width, _ = strconv.Atoi(m[1])
+			variant.Height, _ = strconv.Atoi(m[2])
+		}
+		variants = append(variants, variant)
 	}
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].Bitrate > variants[j].Bitrate
+	})
+	return variants
+}
+
+// truncateRunes は s を n 文字までに切り詰めます。
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// lookupErrorMessage はツイートを検索できなかった理由を返信する文章にします。
+func lookupErrorMessage(err error) string {
+	switch err {
+	case ErrTweetNotFound:
+		return "ツイートが見つかりませんでした。削除されたか、非公開のアカウントのツイートです。"
+	case ErrTweetProtected:
+		return "非公開のアカウントのツイートはダウンロードできません。"
+	default:
+		return "ツイートの取得に失敗しました。時間をおいてもう一度お試しください。"
+	}
+}
+
+// downloadsURL はユーザーがダウンロードした動画の一覧のページのURLを返します。
+func (b *Bot) downloadsURL(screenName string) string {
+	return b.Config().publicURL() + "/downloads/" + url.PathEscape(screenName)
 }
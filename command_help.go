@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+func helpCommand(b *Bot, s CommandSender, args *Args) {
+	if label, ok := args.Text("command"); ok {
+		command, ok := b.commands.Lookup(strings.ToLower(label))
+		if !ok || !b.Config().CommandEnabled(command) || !command.Accepts(s) {
+			s.SendMessage("「" + label + "」というコマンドは存在しません。")
+			return
+		}
+		s.SendMessage(formatCommandHelp(command))
+		return
+	}
+
+	config := b.Config()
+	var names []string
+	for _, command := range b.commands.Commands() {
+		if config.CommandEnabled(command) && command.Accepts(s) {
+			names = append(names, command.Name)
+		}
+	}
+
+	switch s.(type) {
+	case TimelineSender:
+		// ツイートの文字数制限があるため、リプライではコマンド名だけを返します。
+		s.SendMessage("コマンド一覧: " + strings.Join(names, ", ") + "\n詳しくは help <コマンド名> と送信してください。")
+	default:
+		var sb strings.Builder
+		sb.WriteString("コマンド一覧\n")
+		for _, command := range b.commands.Commands() {
+			if config.CommandEnabled(command) && command.Accepts(s) {
+				sb.WriteString("\n")
+				sb.WriteString(formatCommandHelp(command))
+				sb.WriteString("\n")
+			}
+		}
+		s.SendMessage(strings.TrimSpace(sb.String()))
+	}
+}
+
+func formatCommandHelp(c *Command) string {
+	var sb strings.Builder
+	sb.WriteString(c.Name)
+	if len(c.Aliases) > 0 {
+		sb.WriteString(" (")
+		sb.WriteString(strings.Join(c.Aliases, ", "))
+		sb.WriteString(")")
+	}
+	sb.WriteString(": ")
+	sb.WriteString(c.Description)
+	if c.Usage != "" {
+		sb.WriteString("\n使い方: ")
+		sb.WriteString(c.Name)
+		sb.WriteString(" ")
+		sb.WriteString(c.Usage)
+	}
+	for _, flag := range c.Flags {
+		sb.WriteString("\n--")
+		sb.WriteString(flag.Name)
+		sb.WriteString(": ")
+		sb.WriteString(flag.Description)
+	}
+	return sb.String()
+}
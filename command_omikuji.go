@@ -1,17 +1,17 @@
 package main
 
 import (
-	"github.com/getsentry/sentry-go"
-	"github.com/go-redis/redis"
 	"github.com/kyokomi/lottery"
 	"github.com/tomocrafter/go-twitter/twitter"
-	"log"
 	"math/rand"
 	"strconv"
 	"sync"
 	"time"
 )
 
+// Redis Key prefix, lottery:<user id>
+const LotteryPrefix = "lottery:"
+
 type Item struct {
 	ItemName string
 	DropProb int
@@ -33,7 +33,7 @@ var (
 	}
 )
 
-func OmikujiCommand(s CommandSender, _ []string) {
+func OmikujiCommand(b *Bot, s CommandSender, _ *Args) {
 	mt.Lock()
 	defer mt.Unlock()
 
@@ -52,65 +52,55 @@ func OmikujiCommand(s CommandSender, _ []string) {
 	}
 
 	// Check If today is in 1/1 - 1/7
-	now := time.Now()
+	now := b.now().In(location)
 	if now.Month() != 1 || now.Day() > 7 {
 		return
 	}
 
-	key := "lottery:" + strconv.FormatInt(id, 10)
-	err := redisClient.Get(key).Err()
-	if err == redis.Nil {
+	// Only the first draw of the day is accepted, until the midnight in Japan.
+	tomorrow := now.AddDate(0, 0, 1)
+	ch := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, location)
+	key := LotteryPrefix + strconv.FormatInt(id, 10)
+	first, err := b.State.SetNX(key, "", ch.Sub(now))
+	if err != nil {
+		s.Sentry().CaptureException(err)
+	} else if first {
 		index := lot.Lots(items...)
 		if index == -1 {
-			log.Fatalln("lot error")
+			s.Logger().Fatal("lot error")
 		}
 
 		if index == 0 {
-			go func() {
-				_, _, err := client.DirectMessages.EventsNew(&twitter.DirectMessageEventsNewParams{
-					Event: &twitter.DirectMessageEvent{
-						Type: "message_create",
-						Message: &twitter.DirectMessageEventMessage{
-							Target: &twitter.DirectMessageTarget{
-								RecipientID: strconv.FormatInt(id, 10),
-							},
-							Data: &twitter.DirectMessageData{
-								Text: "結果は 大吉 でした！おめでとうございます！\nあなたにとって素敵な一年になりますように。\nぜひまた明日も挑戦してください！\nなお、おみくじ機能は1/7まで利用可能です。",
-							},
-						},
-					},
-				})
-				if err != nil {
-					sentry.CaptureException(err)
-				}
-			}()
-			BroadcastMessage(s.GetName() + " (@" + screenName + ") さんが確率 0.05% の大吉を当てました！")
+			sendOmikujiResult(b, s, id, "結果は 大吉 でした！おめでとうございます！\nあなたにとって素敵な一年になりますように。\nぜひまた明日も挑戦してください！\nなお、おみくじ機能は1/7まで利用可能です。")
+			b.BroadcastMessage(s.GetName() + " (@" + screenName + ") さんが確率 0.05% の大吉を当てました！")
 		} else {
-			go func() {
-				_, _, err := client.DirectMessages.EventsNew(&twitter.DirectMessageEventsNewParams{
-					Event: &twitter.DirectMessageEvent{
-						Type: "message_create",
-						Message: &twitter.DirectMessageEventMessage{
-							Target: &twitter.DirectMessageTarget{
-								RecipientID: strconv.FormatInt(id, 10),
-							},
-							Data: &twitter.DirectMessageData{
-								Text: "結果は " + items[index].(Item).ItemName + " でした！ぜひまた明日も挑戦してください！\nなお、おみくじ機能は1/7まで利用可能です。",
-							},
-						},
-					},
-				})
-				if err != nil {
-					sentry.CaptureException(err)
-				}
-			}()
+			sendOmikujiResult(b, s, id, "結果は "+items[index].(Item).ItemName+" でした！ぜひまた明日も挑戦してください！\nなお、おみくじ機能は1/7まで利用可能です。")
 		}
-
-		tomorrow := now.AddDate(0, 0, 1)
-		ch := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 0, 0, 0, 0, location)
-
-		redisClient.SetNX(key, "", ch.Sub(now))
-	} else if err != nil {
-		sentry.CaptureException(err)
 	}
 }
+
+// sendOmikujiResult は結果をダイレクトメッセージで送信します。
+// おみくじのロックを持ったまま待たないように別のゴルーチンで送信し、Shutdown では実行中のコマンドとして待たれます。
+func sendOmikujiResult(b *Bot, s CommandSender, id int64, text string) {
+	b.commandsRunning.Add(1)
+	go func() {
+		defer b.commandsRunning.Done()
+		_, _, err := b.Twitter.SendDirectMessage(&twitter.DirectMessageEventsNewParams{
+			Event: &twitter.DirectMessageEvent{
+				Type: "message_create",
+				Message: &twitter.DirectMessageEventMessage{
+					Target: &twitter.DirectMessageTarget{
+						RecipientID: strconv.FormatInt(id, 10),
+					},
+					Data: &twitter.DirectMessageData{
+						Text: text,
+					},
+				},
+			},
+		})
+		if err != nil {
+			directMessagesFailed.WithLabelValues(errorCodeLabel(err)).Inc()
+			s.Sentry().CaptureException(err)
+		}
+	}()
+}
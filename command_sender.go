@@ -6,107 +6,301 @@ import (
 	"time"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
-var (
-	sendMessageQueue = make(chan Message)
+const (
+	// maxSendAttempts はメッセージをデッドレターに移すまでに送信を試みる回数です。
+	maxSendAttempts = 5
+	// noReplyPollInterval はツイートが制限されている間、制限が解除されたかを確かめる間隔です。
+	noReplyPollInterval = 5 * time.Second
+	// idlePollInterval は送信待ちのメッセージが無い場合に、キューを確かめる間隔です。
+	idlePollInterval = 1 * time.Second
 )
 
-type Message struct {
-	m       string
-	replyID *int64
+// permanentStatusErrors は再送しても成功しないツイートのエラーコードです。
+// https://developer.twitter.com/en/docs/basics/response-codes
+var permanentStatusErrors = map[int]bool{
+	186: true, // Tweet needs to be a bit shorter.
+	187: true, // Status is a duplicate.
+	226: true, // This request looks like it might be automated.
+	385: true, // You attempted to reply to a Tweet that is deleted or not visible to you.
+	433: true, // The original Tweet author restricted who can reply to this Tweet.
+}
+
+// sendBackoff は attempts 回目の失敗の後、次に送信を試みるまでの時間です。
+func sendBackoff(attempts int) time.Duration {
+	d := time.Duration(1<<uint(attempts)) * time.Second
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+	return d
+}
+
+// enqueueMessage は送信キューにメッセージを追加し、送信処理を起こします。
+// ツイートが制限されている間、優先度の低い通知は追加せずに破棄します。
+func (b *Bot) enqueueMessage(m Message) {
+	if m.Priority <= PriorityNotice && b.isReplyBlocked() {
+		return
+	}
+	if err := b.outbound.Enqueue(m, b.now()); err != nil {
+		sentry.CaptureException(fmt.Errorf("error occurred while enqueueing message: %s", err))
+		return
+	}
+	select {
+	case b.outboundWake <- struct{}{}:
+	default:
+	}
+}
+
+// waitOutbound は d が経過するか、新しいメッセージが追加されるまで待ちます。
+func (b *Bot) waitOutbound(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.outboundWake:
+	case <-b.quit:
+	}
+}
+
+// isQuitting は終了のためにキューを処理し終えるところかを返します。
+func (b *Bot) isQuitting() bool {
+	select {
+	case <-b.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// blockReplies は reset までツイートを止め、送信待ちの通知を破棄します。
+func (b *Bot) blockReplies(reset time.Time) {
+	logger.WithField("reset", reset).Warn("Rate limit reached")
+	b.profile.Set(ProfileRateLimited, true)
+	// Round up, so that the block is lifted after the reset.
+	if err := b.State.Set(NoReply, strconv.FormatInt(reset.Add(time.Second-1).Unix(), 10), 0); err != nil {
+		sentry.CaptureException(err)
+	}
+	if n, err := b.outbound.Shed(PriorityNotice); err != nil {
+		sentry.CaptureException(err)
+	} else if n > 0 {
+		logger.WithField("count", n).Info("Dropped notices because of tweet limit")
+	}
+}
+
+// noReplyUntil はツイートの制限が解除される時間を返します。制限されていない場合はゼロを返します。
+func (b *Bot) noReplyUntil() time.Time {
+	value, err := b.State.Get(NoReply)
+	if err != nil {
+		return time.Time{}
+	}
+	nextReset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || nextReset <= b.now().Unix() {
+		return time.Time{}
+	}
+	return time.Unix(nextReset, 0)
 }
 
 // メッセージは、キューイングする必要があります。
 // 1リクエストごとにRedisとコミュニケーションしツイートが制限されているか確かめる必要があるからです。
-func MessageSendTicker() {
-	changeName := func(name string, client *twitter.Client) {
-		_, _, _ = client.Accounts.UpdateProfile(&twitter.AccountProfileParams{
-			Name:            name,
-			IncludeEntities: twitter.Bool(false),
-			SkipStatus:      twitter.Bool(true),
-		})
-	}
-
-	for message := range sendMessageQueue {
-		canReply, isUnlocked := checkCanReply()
-		if !canReply {
-			return
-		}
+// ツイートが制限されている間、メッセージはキューに残り、制限が解除されてから送信されます。
+// 終了するときは、すぐに送信できるメッセージをすべて送信してから戻ります。
+func (b *Bot) MessageSendTicker() {
+	if n, err := b.outbound.Recover(b.now()); err != nil {
+		sentry.CaptureException(fmt.Errorf("error occurred while recovering outbound queue: %s", err))
+	} else if n > 0 {
+		logger.WithField("count", n).Info("Recovered messages that were being sent")
+	}
 
-		params := &twitter.StatusUpdateParams{}
-		if message.replyID != nil {
-			params.TrimUser = twitter.Bool(true)
-			params.InReplyToStatusID = *message.replyID
-		}
+	for {
+		quitting := b.isQuitting()
 
-		_, _, e := client.Statuses.Update(message.m, params)
+		// noReplyUntil does not change the stored block, so nothing is lost when the queue turns out to be empty.
+		if reset := b.noReplyUntil(); !reset.IsZero() {
+			if quitting {
+				return // Messages are sent after restarting.
+			}
+			wait := noReplyPollInterval
+			if d := reset.Sub(b.now()); d < wait {
+				wait = d
+			}
+			select {
+			case <-time.After(wait):
+			case <-b.quit:
+			}
+			continue
+		}
 
-		if isUnlocked && e == nil {
-			changeName("tomobotter", client)
-		} else if e != nil {
-			if e.(twitter.APIError).Errors[0].Code == 185 { // User is over daily status update limit
-				fmt.Println("\x1b[31m        Rate Limit Reached!        \x1b[0m")
-				changeName("tomobotter@ツイート制限中", client)
-				redisClient.Set(NoReply, time.Now().Add(10*time.Minute).Unix(), 0)
+		message, ok, err := b.outbound.Next(b.now())
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("error occurred while dequeueing message: %s", err))
+			if quitting {
+				return
 			}
+			select {
+			case <-time.After(idlePollInterval):
+			case <-b.quit:
+			}
+			continue
+		}
+		if !ok {
+			if quitting {
+				return
+			}
+			b.waitOutbound(idlePollInterval)
+			continue
+		}
+
+		if err := b.sendOutbound(message); err != nil {
+			sentry.CaptureException(err)
 		}
 	}
 }
 
-/*
-checkCanReply はツイートができるか、そしてこのリクエストが制限が解除されてから一度目かをRedisに問い合わせて返します。
-
-必要:
-送信するときに、API制限中かどうか。
-API制限が終わってから一回目かどうか。
-
-つまり:
-no-reply-id:制限が解除される時間 をRedisに保存しておく。
-キーが無かった場合は制限されていないのでAPIは制限されていない。
-キーが合った場合は、その値をint64でパースする。
-今の時間より解除される時間のが多かった=まだ解除されていない。
-今の時間より解除される時間のが少なかった=解除された。さらに、キーがあるため解除されてから一回目のAPIコール。
-*/
-func checkCanReply() (canTweet, isUnlocked bool) {
-	nextResetStr, err := redisClient.Get(NoReply).Result()
-	if err == redis.Nil {
-		nextResetStr = "0"
-		redisClient.Set(NoReply, "0", 0)
-		return true, false
-	} else if err != nil {
-		sentry.CaptureException(err)
-		return true, false // If error occurred on Redis, Try to replyId.
+// sendOutbound はツイートの残りの数に応じて、メッセージを送信するか、後回しにするか、破棄します。
+func (b *Bot) sendOutbound(message Message) error {
+	// Errors are reported with the command that queued the message.
+	hub := sentry.CurrentHub().Clone()
+	hub.Scope().SetTags(map[string]string{
+		"correlation_id": message.CorrelationID,
+		"message_id":     message.ID,
+		"priority":       message.Priority.String(),
+	})
+
+	budget, err := b.TweetBudget()
+	if err != nil {
+		hub.CaptureException(fmt.Errorf("error occurred while checking tweet budget: %s", err))
+	}
+	reserve := b.Config().TweetBudget
+
+	switch {
+	case budget.Remaining <= 0:
+		// We know that tweet will fail, so block until the oldest tweet leaves the window.
+		b.blockReplies(budget.ResetAt)
+		if message.Priority <= PriorityNotice {
+			return b.outbound.DeadLetter(message)
+		}
+		return b.outbound.Retry(message, budget.ResetAt)
+	case message.Priority <= PriorityNotice && budget.Remaining <= reserve.NoticeReserve:
+		message.LastError = "shed to save tweet budget"
+		return b.outbound.DeadLetter(message)
+	case message.Priority == PriorityBroadcast && budget.Remaining <= reserve.BroadcastReserve:
+		return b.outbound.Retry(message, budget.ResetAt)
+	case message.Priority == PriorityReply && budget.Remaining <= reserve.DMFallbackReserve && message.RecipientID != 0:
+		if b.sendDirectMessageFallback(hub, message) {
+			return b.outbound.Ack(message)
+		}
+	}
+
+	params := &twitter.StatusUpdateParams{}
+	if message.ReplyID != 0 {
+		params.TrimUser = twitter.Bool(true)
+		params.InReplyToStatusID = message.ReplyID
+	}
+
+	_, _, e := b.Twitter.UpdateStatus(message.Text, params)
+
+	log := logger.WithFields(logrus.Fields{
+		"correlation_id": message.CorrelationID,
+		"message_id":     message.ID,
+		"priority":       message.Priority.String(),
+	})
+	if e == nil {
+		log.Info("Sent tweet")
+		tweetsSent.WithLabelValues(message.Priority.String()).Inc()
+		if err := b.recordTweet(message.ID, b.now()); err != nil {
+			hub.CaptureException(err)
+		}
+		// A tweet went through, so the limit is lifted whoever set it.
+		b.profile.Set(ProfileRateLimited, false)
+		return b.outbound.Ack(message)
 	}
 
-	if nextReset, err := strconv.ParseInt(nextResetStr, 10, 64); err == nil {
-		if nextReset > time.Now().Unix() {
-			return false, false
-		} else if nextReset == 0 {
-			return true, false
-		} else {
-			redisClient.Set(NoReply, "0", 0)
-			return true, true
+	code := apiErrorCode(e)
+	tweetsFailed.WithLabelValues(errorCodeLabel(e)).Inc()
+	log.WithError(e).WithField("code", code).Warn("Could not send tweet")
+	message.LastError = e.Error()
+	switch {
+	case code == 185: // User is over daily status update limit
+		// If our own count explains the limit, the block is lifted when the oldest tweet leaves the window.
+		// Otherwise someone else is tweeting with this account, so just wait a while.
+		reset := b.now().Add(10 * time.Minute)
+		if budget.Used >= budget.Limit && budget.ResetAt.After(b.now()) {
+			reset = budget.ResetAt
+		}
+		b.blockReplies(reset)
+
+		// This message is not wrong, so send it again after the limit is lifted.
+		// But low priority messages are no longer worth to be sent.
+		if message.Priority <= PriorityNotice {
+			return b.outbound.DeadLetter(message)
+		}
+		return b.outbound.Retry(message, reset)
+	case permanentStatusErrors[code]:
+		return b.outbound.DeadLetter(message)
+	default:
+		message.Attempts++
+		if message.Attempts >= maxSendAttempts {
+			hub.CaptureException(fmt.Errorf("giving up sending message %s after %d attempts: %s", message.ID, message.Attempts, e))
+			return b.outbound.DeadLetter(message)
+		}
+		return b.outbound.Retry(message, b.now().Add(sendBackoff(message.Attempts)))
+	}
+}
+
+// sendDirectMessageFallback はリプライの代わりにダイレクトメッセージで返信します。
+// 送信できた場合はtrueを返します。
+func (b *Bot) sendDirectMessageFallback(hub *sentry.Hub, message Message) bool {
+	_, _, err := b.Twitter.SendDirectMessage(&twitter.DirectMessageEventsNewParams{
+		Event: &twitter.DirectMessageEvent{
+			Type: "message_create",
+			Message: &twitter.DirectMessageEventMessage{
+				Target: &twitter.DirectMessageTarget{
+					RecipientID: strconv.FormatInt(message.RecipientID, 10),
+				},
+				Data: &twitter.DirectMessageData{
+					Text: message.Body,
+				},
+			},
+		},
+	})
+	if err != nil {
+		directMessagesFailed.WithLabelValues(errorCodeLabel(err)).Inc()
+		if apiErrorCode(err) != 349 { // You cannot send messages to this user
+			hub.CaptureException(err)
 		}
-	} else { // If redis returned no-replyId as not int.
-		redisClient.Set(NoReply, "0", 0)
-		return true, false
 	}
+	return err == nil
 }
 
-func BroadcastMessage(message string) {
-	sendMessageQueue <- Message{m: message}
+// isReplyBlocked はツイートの制限中かを返します。
+func (b *Bot) isReplyBlocked() bool {
+	return !b.noReplyUntil().IsZero()
+}
+
+func (b *Bot) BroadcastMessage(message string) {
+	b.enqueueMessage(newMessage(message, 0, PriorityBroadcast))
 }
 
 type CommandSender interface {
 	// SendMessage はコマンドの送信主に対し返信します。
-	// このメソッドは現在のルーチンをブロックします。
+	// リプライは送信キューに追加され、ダイレクトメッセージはすぐに送信されます。
 	SendMessage(message string)
 
+	// SendNotice は送信できなくても問題ない通知を送信します。
+	// リプライの場合、ツイートが制限されている間は破棄されます。
+	SendNotice(message string)
+
 	// GetName はコマンドの送信主の名前を返します。
 	GetName() string
+
+	// Logger はこのコマンドの実行に関するログを出力するロガーを返します。
+	Logger() *logrus.Entry
+
+	// Sentry はこのコマンドの情報をタグに持つSentryのハブを返します。
+	Sentry() *sentry.Hub
 }
 
 type TwitterSender interface {
@@ -116,8 +310,27 @@ type TwitterSender interface {
 
 // Timeline Sender
 type TimelineSender struct {
+	Bot        *Bot
 	Tweet      *twitter.Tweet
 	ReplyCache *twitter.Tweet
+	// Log はイベントのIDと送信主をフィールドに持つロガーです。
+	Log *logrus.Entry
+	// Hub は Dispatch で作成される、コマンドの情報をタグに持つハブです。
+	Hub *sentry.Hub
+}
+
+func (s TimelineSender) Logger() *logrus.Entry {
+	if s.Log == nil {
+		return logrus.NewEntry(logger)
+	}
+	return s.Log
+}
+
+func (s TimelineSender) Sentry() *sentry.Hub {
+	if s.Hub == nil {
+		return sentry.CurrentHub()
+	}
+	return s.Hub
 }
 
 func (s TimelineSender) GetUserId() int64 {
@@ -129,7 +342,31 @@ func (s TimelineSender) GetScreenName() string {
 }
 
 func (s TimelineSender) SendMessage(message string) {
-	sendMessageQueue <- Message{m: "@" + s.Tweet.User.ScreenName + " " + message, replyID: &s.Tweet.ID}
+	s.enqueue(s.reply(message, PriorityReply))
+}
+
+func (s TimelineSender) SendNotice(message string) {
+	s.enqueue(s.reply(message, PriorityNotice))
+}
+
+func (s TimelineSender) enqueue(m Message) {
+	s.Sentry().AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "send",
+		Message:  "Enqueued reply",
+		Data: map[string]interface{}{
+			"message_id": m.ID,
+			"priority":   m.Priority.String(),
+		},
+	}, nil)
+	s.Bot.enqueueMessage(m)
+}
+
+func (s TimelineSender) reply(message string, priority Priority) Message {
+	m := newMessage("@"+s.Tweet.User.ScreenName+" "+message, s.Tweet.ID, priority)
+	m.RecipientID = s.Tweet.User.ID
+	m.Body = message
+	m.CorrelationID = correlationID(s.Log)
+	return m
 }
 
 func (s TimelineSender) GetName() string {
@@ -138,8 +375,28 @@ func (s TimelineSender) GetName() string {
 
 // DirectMessage Sender
 type DirectMessageSender struct {
+	Bot *Bot
+	// User はペイロードの users から取り出した送信主です。返信は DirectMessageEvent の sender_id に送ります。
 	User               *twitter.User
 	DirectMessageEvent *twitter.DirectMessageEvent
+	// Log はイベントのIDと送信主をフィールドに持つロガーです。
+	Log *logrus.Entry
+	// Hub は Dispatch で作成される、コマンドの情報をタグに持つハブです。
+	Hub *sentry.Hub
+}
+
+func (s DirectMessageSender) Logger() *logrus.Entry {
+	if s.Log == nil {
+		return logrus.NewEntry(logger)
+	}
+	return s.Log
+}
+
+func (s DirectMessageSender) Sentry() *sentry.Hub {
+	if s.Hub == nil {
+		return sentry.CurrentHub()
+	}
+	return s.Hub
 }
 
 func (s DirectMessageSender) GetUserId() int64 {
@@ -151,12 +408,12 @@ func (s DirectMessageSender) GetScreenName() string {
 }
 
 func (s DirectMessageSender) SendMessage(message string) {
-	_, _, err := client.DirectMessages.EventsNew(&twitter.DirectMessageEventsNewParams{
+	_, _, err := s.Bot.Twitter.SendDirectMessage(&twitter.DirectMessageEventsNewParams{
 		Event: &twitter.DirectMessageEvent{
 			Type: "message_create",
 			Message: &twitter.DirectMessageEventMessage{
 				Target: &twitter.DirectMessageTarget{
-					RecipientID: s.User.ScreenName,
+					RecipientID: s.DirectMessageEvent.Message.SenderID,
 				},
 				Data: &twitter.DirectMessageData{
 					Text: message,
@@ -164,14 +421,30 @@ func (s DirectMessageSender) SendMessage(message string) {
 			},
 		},
 	})
+	breadcrumb := &sentry.Breadcrumb{
+		Category: "send",
+		Message:  "Sent direct message",
+	}
 	if err != nil {
-		if err.(twitter.APIError).Errors[0].Code == 349 { // You cannot send messages to this user
+		breadcrumb.Level = sentry.LevelError
+		breadcrumb.Data = map[string]interface{}{"error": err.Error()}
+	}
+	s.Sentry().AddBreadcrumb(breadcrumb, nil)
+
+	if err != nil {
+		directMessagesFailed.WithLabelValues(errorCodeLabel(err)).Inc()
+		if apiErrorCode(err) == 349 { // You cannot send messages to this user
 			return
 		}
-		sentry.CaptureException(err)
+		s.Sentry().CaptureException(err)
 	}
 }
 
+// SendNotice はダイレクトメッセージがツイートの制限を受けないため、SendMessage と同じように送信します。
+func (s DirectMessageSender) SendNotice(message string) {
+	s.SendMessage(message)
+}
+
 func (s DirectMessageSender) GetName() string {
 	return s.User.Name
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// TestDispatchRateLimitDirectMessage は存在しないコマンドとツイートのURLだけのDMにも、返信や検索の前に制限がかかるかを確かめます。
+func TestDispatchRateLimitDirectMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text func(i int) (string, []twitter.URLEntity)
+		// shows は statuses/show が呼ばれるべき回数です。
+		shows int
+	}{
+		{
+			name: "unknown command",
+			text: func(int) (string, []twitter.URLEntity) { return "nope", nil },
+		},
+		{
+			name: "quick time",
+			text: func(i int) (string, []twitter.URLEntity) {
+				url := "https://t.co/abcdefgh" + strconv.Itoa(i)
+				return url, []twitter.URLEntity{{
+					URL:         url,
+					ExpandedURL: "https://twitter.com/target_user/status/" + strconv.Itoa(1263588390613553153+i),
+				}}
+			},
+			shows: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config Config
+			config.RateLimit.Default = RateLimit{Burst: 1, Interval: 60}
+			fake := NewFakeTwitterClient(replayBotUser)
+			bot := newTestBot(t, config, fake, newTestClock())
+
+			for i := 0; i < 3; i++ {
+				text, urls := tt.text(i)
+				bot.Dispatch(testDirectMessage(bot, text, urls...), text)
+			}
+
+			messages := messageTexts(fake.SentDirectMessages())
+			if len(messages) != 2 || messages[1] != rateLimitedMessage(time.Minute) {
+				t.Errorf("sent %q, want a reply and then one rate limit notice", messages)
+			}
+			if n := fake.ShowCalls(); n != tt.shows {
+				t.Errorf("statuses/show called %d times, want %d", n, tt.shows)
+			}
+		})
+	}
+}
+
+// TestDispatchRateLimitBeforeLookup は空のリプライで返信先のツイートを検索する前に制限がかかるかを確かめます。
+func TestDispatchRateLimitBeforeLookup(t *testing.T) {
+	var config Config
+	config.RateLimit.Default = RateLimit{Burst: 1, Interval: 60}
+	fake := NewFakeTwitterClient(replayBotUser)
+	bot := newTestBot(t, config, fake, newTestClock())
+	startTestBot(t, bot)
+
+	bot.Dispatch(testMention(bot, 10, 500), "")
+	bot.Dispatch(testMention(bot, 11, 501), "")
+
+	if n := fake.LookupCalls(); n != 1 {
+		t.Errorf("statuses/lookup called %d times, want 1", n)
+	}
+}
+
+// TestDispatchEmptyDirectMessage は空のDMにコマンドの一覧を返すかを確かめます。
+func TestDispatchEmptyDirectMessage(t *testing.T) {
+	fake := NewFakeTwitterClient(replayBotUser)
+	bot := newTestBot(t, Config{}, fake, newTestClock())
+	bot.Dispatch(testDirectMessage(bot, ""), "")
+
+	help, _ := bot.commands.Lookup("help")
+	disabled := false
+	bot.config.Store(Config{Commands: map[string]CommandConfig{help.Name: {Enabled: &disabled}}})
+	bot.Dispatch(testDirectMessage(bot, ""), "")
+
+	messages := messageTexts(fake.SentDirectMessages())
+	if len(messages) != 1 || !strings.HasPrefix(messages[0], "コマンド一覧\n") {
+		t.Errorf("sent %q, want only the command list", messages)
+	}
+}
+
+// TestOmikujiResultSentBeforeShutdown はおみくじの結果を送信し終えるまで Shutdown が待つかを確かめます。
+func TestOmikujiResultSentBeforeShutdown(t *testing.T) {
+	fake := NewFakeTwitterClient(replayBotUser)
+	fake.SetDirectMessageDelay(100 * time.Millisecond)
+	clock := &testClock{t: time.Date(2021, 1, 2, 12, 0, 0, 0, location)}
+	bot := newTestBot(t, Config{}, fake, clock)
+	bot.Start()
+
+	bot.dispatchAsync(testDirectMessage(bot, "omikuji"), "omikuji")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bot.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	messages := messageTexts(fake.SentDirectMessages())
+	if len(messages) != 1 || !strings.HasPrefix(messages[0], "結果は ") {
+		t.Errorf("sent %q before Shutdown returned, want the result", messages)
+	}
+}
@@ -8,8 +8,6 @@ import (
 	"strings"
 	"time"
 
-	mapset "github.com/deckarep/golang-set"
-	"github.com/getsentry/sentry-go"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
@@ -39,6 +37,10 @@ func formatTime(t time.Time) string {
 	return t.Format("15:04:05.000")
 }
 
+func formatDateTime(t time.Time) string {
+	return t.Format("2006/01/02 15:04:05.000")
+}
+
 func getTweetIDFromURL(url string) (int64, bool) {
 	match := pattern.FindStringSubmatch(url)
 	if len(match) > 3 {
@@ -48,15 +50,15 @@ func getTweetIDFromURL(url string) (int64, bool) {
 	return 0, false
 }
 
-func interfaceToInt64(i []interface{}) []int64 {
-	f := make([]int64, len(i))
-	for n := range i {
-		f[n] = i[n].(int64)
+// tweetText はツイートの本文を返します。tweet_mode=extended で取得したツイートは full_text に本文が入ります。
+func tweetText(tweet twitter.Tweet) string {
+	if tweet.FullText != "" {
+		return tweet.FullText
 	}
-	return f
+	return tweet.Text
 }
 
-func timeCommand(s CommandSender, args []string) {
+func timeCommand(b *Bot, s CommandSender, args *Args) {
 	switch s := s.(type) {
 	case TimelineSender:
 		if s.Tweet.InReplyToStatusID == 0 { // Error
@@ -72,9 +74,9 @@ func timeCommand(s CommandSender, args []string) {
 			return
 		}
 
-		if IsTimeRestricting() {
-			tweet := queueProcessor.LookupTweetBlocking(s.Tweet.InReplyToStatusID)
-			if tweet.Text != "334" {
+		if b.IsTimeRestricting() {
+			tweet, err := b.lookupTweet(s.Sentry(), s.Tweet.InReplyToStatusID)
+			if err != nil || tweetText(tweet) != "334" {
 				return
 			}
 		}
@@ -97,101 +99,87 @@ func timeCommand(s CommandSender, args []string) {
 		}
 
 	case DirectMessageSender:
-		ids := mapset.NewThreadUnsafeSet()
-		urls := make(map[string]string, len(s.DirectMessageEvent.Message.Data.Entities.Urls)) // Shorten URL -> Expanded URL
-		for _, url := range s.DirectMessageEvent.Message.Data.Entities.Urls {
-			urls[url.URL] = url.ExpandedURL
-		}
-		for _, v := range args {
-			if id, err := strconv.ParseInt(v, 10, 64); err == nil {
-				ids.Add(id)
-				continue
-			}
-
-			if url, ok := urls[v]; ok {
-				if id, ok := getTweetIDFromURL(url); ok {
-					ids.Add(id)
-				} else {
-					s.SendMessage(InvalidArgumentError)
-				}
-			} else {
-				s.SendMessage(InvalidArgumentError)
+		var ids []int64
+		seen := make(map[int64]bool)
+		for _, id := range args.Tweets("tweets") {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
 			}
 		}
 
-		if ids.Cardinality() == 0 {
-			return
+		format := formatTime
+		if args.Flag("date") {
+			format = formatDateTime
 		}
 
 		var sb strings.Builder
 		sb.WriteString("2010年11月以前のツイートでは正常に動作しません。\n\n")
 
-		tweets, _, err := client.Statuses.Lookup(interfaceToInt64(ids.ToSlice()), &twitter.StatusLookupParams{
-			IncludeEntities: twitter.Bool(false),
-		})
-		if err != nil {
-			sentry.CaptureException(err)
-			return
-		}
-		for _, tweet := range tweets {
-			ids.Remove(tweet.ID)
+		results := b.lookupTweets(s.Sentry(), ids)
+		var notFound []int64
+		for i, r := range results {
+			if r.err != nil {
+				if r.err != ErrTweetNotFound && r.err != ErrTweetProtected {
+					s.SendMessage("ツイートの取得に失敗しました。時間をおいてもう一度お試しください。")
+					return
+				}
+				notFound = append(notFound, ids[i])
+				continue
+			}
+			tweet := r.tweet
 
 			sb.WriteByte('@')
 			sb.WriteString(tweet.User.ScreenName)
 			sb.WriteByte(':')
 			sb.WriteByte('\n')
-			sb.WriteString(tweet.Text)
+			sb.WriteString(tweetText(tweet))
 			sb.WriteByte('\n')
-			sb.WriteString(formatTime(twitterIdToTime(tweet.ID)))
+			sb.WriteString(format(twitterIdToTime(tweet.ID)))
 			sb.WriteString("\n\n")
 		}
 
-		ids.Each(func(i interface{}) bool {
-			if i != 0 {
-				sb.WriteString("\n\n")
-			}
+		for _, id := range notFound {
 			sb.WriteString(strconv.FormatInt(id, 10))
-			sb.WriteString(" は存在しないか非公開のアカウントのツイートです。")
-			return false
-		})
+			sb.WriteString(" は存在しないか非公開のアカウントのツイートです。\n\n")
+		}
 
-		s.SendMessage(sb.String())
+		s.SendMessage(strings.TrimSpace(sb.String()))
 	}
 	return
 }
 
-func handleQuickTime(s DirectMessageSender) {
-	if len(s.DirectMessageEvent.Message.Data.Entities.Urls) == 1 &&
-		s.DirectMessageEvent.Message.Data.Text == s.DirectMessageEvent.Message.Data.Entities.Urls[0].URL {
-
-		url := s.DirectMessageEvent.Message.Data.Entities.Urls[0].ExpandedURL
-
-		if id, ok := getTweetIDFromURL(url); ok {
-			tweet, resp, err := client.Statuses.Show(id, &twitter.StatusShowParams{
-				IncludeMyRetweet: twitter.Bool(false),
-				IncludeEntities:  twitter.Bool(false),
-			})
-			if err != nil {
-				if resp != nil {
-					if resp.StatusCode == 404 {
-						s.SendMessage(strconv.FormatInt(id, 10) + " は存在しないツイートです。")
-					} else if resp.StatusCode == 403 {
-						s.SendMessage("このツイートは非公開アカウントのツイートか、取得できないツイートです。")
-					}
-				} else {
-					sentry.CaptureException(err)
-				}
-			} else {
-				var sb strings.Builder
-				sb.WriteByte('@')
-				sb.WriteString(tweet.User.ScreenName)
-				sb.WriteString(":\n")
-				sb.WriteString(tweet.Text)
-				sb.WriteString("\n")
-				sb.WriteString(formatTime(twitterIdToTime(tweet.ID)))
-
-				s.SendMessage(sb.String())
-			}
+// quickTimeTweetID はツイートのURLだけが送られてきた場合に、そのツイートのIDを返します。
+func quickTimeTweetID(s DirectMessageSender) (int64, bool) {
+	data := s.DirectMessageEvent.Message.Data
+	if data.Entities == nil || len(data.Entities.Urls) != 1 || data.Text != data.Entities.Urls[0].URL {
+		return 0, false
+	}
+	return getTweetIDFromURL(data.Entities.Urls[0].ExpandedURL)
+}
+
+// quickTime は quickTimeTweetID で見つけたツイートの時間を返信します。
+func quickTime(s DirectMessageSender, id int64) {
+	tweet, err := s.Bot.showTweet(s.Sentry(), id)
+	if err != nil {
+		switch err {
+		case ErrTweetNotFound:
+			s.SendMessage(strconv.FormatInt(id, 10) + " は存在しないツイートです。")
+		case ErrTweetProtected:
+			s.SendMessage("このツイートは非公開アカウントのツイートか、取得できないツイートです。")
+		default:
+			s.SendMessage(lookupErrorMessage(err))
 		}
+		return
 	}
+
+	var sb strings.Builder
+	sb.WriteByte('@')
+	sb.WriteString(tweet.User.ScreenName)
+	sb.WriteString(":\n")
+	sb.WriteString(tweetText(tweet))
+	sb.WriteString("\n")
+	sb.WriteString(formatTime(twitterIdToTime(tweet.ID)))
+
+	s.SendMessage(sb.String())
 }
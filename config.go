@@ -13,6 +13,21 @@ type Config struct {
 		User     string `json:"user"`
 		Password string `json:"password"`
 	} `json:"mysql"`
+	SQLite struct {
+		// Path はデータベースのファイルのパスです。:memory: の場合はメモリ上に作成します。
+		Path string `json:"path"`
+	} `json:"sqlite"`
+	Database struct {
+		// Driver は "mysql" か "sqlite" です。空の場合は mysql です。
+		Driver string `json:"driver"`
+		// AutoMigrate が true の場合、起動するときに適用されていないマイグレーションを適用します。
+		AutoMigrate bool `json:"auto_migrate"`
+	} `json:"database"`
+	State struct {
+		// Driver は "redis" か "memory" です。空の場合は redis です。
+		// memory の場合はRedisを使わずにメモリ上に保存するため、再起動すると状態は失われ、複数のプロセスでは共有できません。
+		Driver string `json:"driver"`
+	} `json:"state"`
 	Redis struct {
 		DB       int    `json:"db"`
 		Addr     string `json:"addr"`
@@ -24,4 +39,83 @@ type Config struct {
 	Sentry struct {
 		Dsn string `json:"dsn"`
 	} `json:"sentry"`
+	// Commands はコマンド名ごとの設定です。
+	Commands  map[string]CommandConfig `json:"commands"`
+	RateLimit struct {
+		Default RateLimit `json:"default"`
+		// Commands はコマンド名ごとの制限です。指定されていないコマンドには Default が適用されます。
+		Commands map[string]RateLimit `json:"commands"`
+	} `json:"rate_limit"`
+	TweetBudget struct {
+		// DailyLimit は直近24時間にツイートできる数です。0の場合は2400です。
+		DailyLimit int `json:"daily_limit"`
+		// 残りのツイートの数がそれぞれの値以下になると、通知を破棄し、お知らせを後回しにし、
+		// リプライの代わりにダイレクトメッセージで返信します。0の場合は何もしません。
+		NoticeReserve     int `json:"notice_reserve"`
+		BroadcastReserve  int `json:"broadcast_reserve"`
+		DMFallbackReserve int `json:"dm_fallback_reserve"`
+	} `json:"tweet_budget"`
+	// Profile は状態ごとにBotのプロフィールをどのように変更するかの設定です。
+	Profile struct {
+		RateLimited ProfileTemplate `json:"rate_limited"`
+		Maintenance ProfileTemplate `json:"maintenance"`
+		Restricted  ProfileTemplate `json:"restricted"`
+	} `json:"profile"`
+	TweetCache struct {
+		// Size はメモリ上にキャッシュするツイートの数です。0の場合は1000です。
+		Size int `json:"size"`
+		// TTL はツイートをキャッシュする秒数です。0の場合は1時間です。
+		TTL int `json:"ttl"`
+		// NegativeTTL は削除されたツイートや非公開のツイートをキャッシュする秒数です。0の場合は5分です。
+		NegativeTTL int `json:"negative_ttl"`
+	} `json:"tweet_cache"`
+	Log struct {
+		// Level は出力するログのレベルです。debug にするとWebhookのペイロードも出力します。空の場合は info です。
+		Level string `json:"level"`
+		// Format は "json" か "text" です。空の場合は json です。
+		Format string `json:"format"`
+	} `json:"log"`
+	Server struct {
+		// Listeners はHTTPサーバーが待ち受けるアドレスです。空の場合は /var/run/twitter/bot.sock で待ち受けます。
+		Listeners []ListenerConfig `json:"listeners"`
+		// AllowOrigins はCORSで許可するオリジンです。空の場合は https://bot.tomocraft.net です。
+		AllowOrigins []string `json:"allow_origins"`
+		// PublicURL はダウンロードページのURLを返信するときに使う、公開されているURLです。空の場合は https://bot.tomocraft.net です。
+		PublicURL string `json:"public_url"`
+	} `json:"server"`
+	// ShutdownTimeout は終了するときに実行中のコマンドと送信キューを待つ秒数です。0の場合は30秒です。
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// Maintenance が true の場合、プロフィールをメンテナンス中の表示にします。
+	Maintenance bool `json:"maintenance"`
+}
+
+// CommandConfig はコマンドごとの設定です。
+type CommandConfig struct {
+	// Enabled が false の場合、コマンドは存在しないものとして扱われます。省略した場合はコマンドの既定に従います。
+	Enabled *bool `json:"enabled"`
+}
+
+// CommandEnabled はコマンドが有効かを返します。
+func (c Config) CommandEnabled(command *Command) bool {
+	if cc, ok := c.Commands[command.Name]; ok && cc.Enabled != nil {
+		return *cc.Enabled
+	}
+	return command.Enabled
+}
+
+// RateLimit はユーザーごと、コマンドごとのトークンバケットの設定です。
+// Burst が0の場合は制限しません。
+type RateLimit struct {
+	// Burst は連続して実行できる回数です。
+	Burst int `json:"burst"`
+	// Interval は実行できる回数が1回分回復するまでの秒数です。
+	Interval int `json:"interval"`
+}
+
+// RateLimitFor はコマンドに適用される制限を返します。
+func (c Config) RateLimitFor(command string) RateLimit {
+	if limit, ok := c.RateLimit.Commands[command]; ok {
+		return limit
+	}
+	return c.RateLimit.Default
 }
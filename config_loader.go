@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix は設定を上書きする環境変数の接頭辞です。
+// 例えば twitter.consumer_key は TOMOBOTTER_TWITTER_CONSUMER_KEY で上書きできます。
+const EnvPrefix = "TOMOBOTTER_"
+
+// ConfigError は設定の誤りをまとめたエラーです。
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// defaultConfig は設定ファイルと環境変数で指定されなかった項目の値を返します。
+// スライスとマップは読み込むときに要素が混ざらないように、ここでは指定しません。
+func defaultConfig() Config {
+	var config Config
+	config.Database.Driver = "mysql"
+	config.Path.Webhook = "/webhook"
+	config.TweetBudget.DailyLimit = defaultDailyTweetLimit
+	config.TweetCache.Size = defaultTweetCacheSize
+	config.TweetCache.TTL = int(defaultTweetCacheTTL.Seconds())
+	config.TweetCache.NegativeTTL = int(defaultTweetCacheNegativeTTL.Seconds())
+	config.Log.Level = "info"
+	config.Log.Format = "json"
+	config.Server.PublicURL = defaultPublicURL
+	config.ShutdownTimeout = int(defaultShutdownTimeout.Seconds())
+	return config
+}
+
+// LoadConfig は path から設定を読み込み、環境変数で上書きしてから検証します。
+// 拡張子が .yaml か .yml の場合はYAML、それ以外はJSONとして読み込みます。
+// path が空の場合はファイルを読まずに、既定値と環境変数だけを使います。
+// 誤りがある場合は、すべての誤りをまとめた ConfigError を返します。
+func LoadConfig(path string) (Config, error) {
+	config := defaultConfig()
+	if path != "" {
+		if err := readConfigFile(path, &config); err != nil {
+			return config, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	errs := applyEnv(reflect.ValueOf(&config).Elem(), nil, os.LookupEnv)
+	errs = append(errs, config.validate()...)
+	if len(errs) > 0 {
+		return config, errs
+	}
+	return config, nil
+}
+
+func readConfigFile(path string, config *Config) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// Convert to JSON so that the same field names are used for both formats.
+		var v interface{}
+		if err := yaml.Unmarshal(file, &v); err != nil {
+			return err
+		}
+		file, err = json.Marshal(jsonCompatible(v))
+		if err != nil {
+			return err
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+// jsonCompatible はYAMLのマップを json.Marshal できる形に変換します。
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+	}
+	return v
+}
+
+// applyEnv は構造体 v のフィールドを環境変数で上書きします。
+// 環境変数の名前は EnvPrefix と、JSONのフィールド名をたどって _ でつないだものを大文字にしたものです。
+// 文字列のスライスはカンマ区切り、それ以外のスライスとマップはJSONで指定します。
+func applyEnv(v reflect.Value, path []string, lookup func(string) (string, bool)) ConfigError {
+	var errs ConfigError
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		fieldPath := append(append([]string(nil), path...), name)
+
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(field, fieldPath, lookup)...)
+			continue
+		}
+
+		key := EnvPrefix + strings.ToUpper(strings.Join(fieldPath, "_"))
+		value, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(field, value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	return errs
+}
+
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			var values []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					values = append(values, s)
+				}
+			}
+			field.Set(reflect.ValueOf(values))
+			return nil
+		}
+		fallthrough
+	case reflect.Map:
+		ptr := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %s", err)
+		}
+		field.Set(ptr.Elem())
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// validate は設定を検証し、見つかったすべての誤りを返します。
+func (c Config) validate() ConfigError {
+	var errs ConfigError
+	required := func(name, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, name+" is required")
+		}
+	}
+	nonNegative := func(name string, value int) {
+		if value < 0 {
+			errs = append(errs, fmt.Sprintf("%s must not be negative: %d", name, value))
+		}
+	}
+
+	required("twitter.consumer_key", c.Twitter.ConsumerKey)
+	required("twitter.consumer_secret", c.Twitter.ConsumerSecret)
+	required("twitter.access_token", c.Twitter.AccessToken)
+	required("twitter.access_token_secret", c.Twitter.AccessTokenSecret)
+
+	switch c.Database.Driver {
+	case "", "mysql":
+		required("mysql.db", c.MySQL.DB)
+		required("mysql.addr", c.MySQL.Addr)
+		required("mysql.user", c.MySQL.User)
+	case "sqlite":
+		required("sqlite.path", c.SQLite.Path)
+	default:
+		errs = append(errs, fmt.Sprintf("database.driver must be mysql or sqlite: %q", c.Database.Driver))
+	}
+
+	switch c.State.Driver {
+	case "", StateDriverRedis:
+		required("redis.addr", c.Redis.Addr)
+		nonNegative("redis.db", c.Redis.DB)
+	case StateDriverMemory:
+	default:
+		errs = append(errs, fmt.Sprintf("state.driver must be redis or memory: %q", c.State.Driver))
+	}
+
+	switch webhook := c.Path.Webhook; {
+	case webhook == "":
+		errs = append(errs, "path.webhook is required")
+	case !strings.HasPrefix(webhook, "/") || webhook == "/":
+		errs = append(errs, fmt.Sprintf("path.webhook must be a path other than /: %q", webhook))
+	}
+
+	commands := make(map[string]bool)
+	for _, command := range defaultCommands() {
+		commands[command.Name] = true
+	}
+	validateRateLimit := func(name string, limit RateLimit) {
+		nonNegative(name+".burst", limit.Burst)
+		nonNegative(name+".interval", limit.Interval)
+		if limit.Burst > 0 && limit.Interval == 0 {
+			errs = append(errs, name+".interval is required when burst is set")
+		}
+	}
+	commandNames := make([]string, 0, len(c.Commands))
+	for command := range c.Commands {
+		commandNames = append(commandNames, command)
+	}
+	sort.Strings(commandNames)
+	for _, command := range commandNames {
+		if !commands[command] {
+			errs = append(errs, fmt.Sprintf("commands: unknown command %q", command))
+		}
+	}
+
+	validateRateLimit("rate_limit.default", c.RateLimit.Default)
+	names := make([]string, 0, len(c.RateLimit.Commands))
+	for command := range c.RateLimit.Commands {
+		names = append(names, command)
+	}
+	sort.Strings(names)
+	for _, command := range names {
+		if !commands[command] {
+			errs = append(errs, fmt.Sprintf("rate_limit.commands: unknown command %q", command))
+		}
+		validateRateLimit("rate_limit.commands."+command, c.RateLimit.Commands[command])
+	}
+
+	nonNegative("tweet_budget.daily_limit", c.TweetBudget.DailyLimit)
+	for _, reserve := range []struct {
+		name  string
+		value int
+	}{
+		{"tweet_budget.notice_reserve", c.TweetBudget.NoticeReserve},
+		{"tweet_budget.broadcast_reserve", c.TweetBudget.BroadcastReserve},
+		{"tweet_budget.dm_fallback_reserve", c.TweetBudget.DMFallbackReserve},
+	} {
+		nonNegative(reserve.name, reserve.value)
+		if reserve.value >= c.dailyTweetLimit() {
+			errs = append(errs, fmt.Sprintf("%s must be less than the daily limit %d: %d", reserve.name, c.dailyTweetLimit(), reserve.value))
+		}
+	}
+
+	for _, profile := range []struct {
+		name     string
+		template ProfileTemplate
+	}{
+		{"profile.rate_limited", c.Profile.RateLimited},
+		{"profile.maintenance", c.Profile.Maintenance},
+		{"profile.restricted", c.Profile.Restricted},
+	} {
+		fields := []string{profile.template.Name, profile.template.Description, profile.template.Location}
+		for i, field := range []string{"name", "description", "location"} {
+			if _, err := renderProfileTemplate(fields[i], Profile{}); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: %s", profile.name, field, err))
+			}
+		}
+	}
+
+	nonNegative("tweet_cache.size", c.TweetCache.Size)
+	nonNegative("tweet_cache.ttl", c.TweetCache.TTL)
+	nonNegative("tweet_cache.negative_ttl", c.TweetCache.NegativeTTL)
+
+	if c.Log.Level != "" {
+		if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+			errs = append(errs, "log.level: "+err.Error())
+		}
+	}
+	switch c.Log.Format {
+	case "", "json", "text":
+	default:
+		errs = append(errs, fmt.Sprintf("log.format must be json or text: %q", c.Log.Format))
+	}
+
+	for i, listener := range c.Server.Listeners {
+		name := fmt.Sprintf("server.listeners[%d]", i)
+		switch listener.Network {
+		case "unix", "tcp":
+		default:
+			errs = append(errs, fmt.Sprintf("%s.network must be unix or tcp: %q", name, listener.Network))
+		}
+		required(name+".addr", listener.Addr)
+		if listener.Mode != "" {
+			if listener.Network != "unix" {
+				errs = append(errs, name+".mode is only available for unix sockets")
+			} else if _, err := strconv.ParseUint(listener.Mode, 8, 32); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.mode must be an octal number: %q", name, listener.Mode))
+			}
+		}
+		if listener.useTLS() && (listener.TLS.CertFile == "" || listener.TLS.KeyFile == "") {
+			errs = append(errs, name+".tls requires both cert_file and key_file")
+		}
+	}
+	for i, origin := range c.Server.AllowOrigins {
+		if origin != "*" && !isHTTPURL(origin) {
+			errs = append(errs, fmt.Sprintf("server.allow_origins[%d] must be * or an http(s) origin: %q", i, origin))
+		}
+	}
+	if c.Server.PublicURL != "" && !isHTTPURL(c.Server.PublicURL) {
+		errs = append(errs, fmt.Sprintf("server.public_url must be an http(s) URL: %q", c.Server.PublicURL))
+	}
+
+	nonNegative("shutdown_timeout", c.ShutdownTimeout)
+	return errs
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile は一時ディレクトリに name の設定ファイルを作成し、そのパスを返します。
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tomobotter-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setEnv は環境変数を設定し、テストの終わりに元に戻します。
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+const testConfigYAML = `
+twitter:
+  consumer_key: key
+  consumer_secret: secret
+  access_token: token
+  access_token_secret: token-secret
+database:
+  driver: sqlite
+sqlite:
+  path: ":memory:"
+state:
+  driver: memory
+rate_limit:
+  commands:
+    help:
+      burst: 2
+      interval: 10
+server:
+  allow_origins:
+    - https://example.com
+`
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		check   func(c Config) bool
+		err     string
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: testConfigYAML,
+			check: func(c Config) bool {
+				return c.Twitter.ConsumerKey == "key" && c.SQLite.Path == ":memory:" &&
+					c.RateLimit.Commands["help"] == RateLimit{Burst: 2, Interval: 10} &&
+					reflect.DeepEqual(c.Server.AllowOrigins, []string{"https://example.com"}) &&
+					// 指定されていない項目は既定値のままです。
+					c.Path.Webhook == "/webhook" && c.TweetBudget.DailyLimit == defaultDailyTweetLimit
+			},
+		},
+		{
+			name: "json",
+			file: "config.json",
+			content: `{
+				"twitter": {"consumer_key": "key", "consumer_secret": "secret", "access_token": "token", "access_token_secret": "token-secret"},
+				"database": {"driver": "sqlite"},
+				"sqlite": {"path": ":memory:"},
+				"state": {"driver": "memory"},
+				"path": {"webhook": "/hook"}
+			}`,
+			check: func(c Config) bool {
+				return c.Twitter.ConsumerKey == "key" && c.Path.Webhook == "/hook"
+			},
+		},
+		{
+			name:    "unknown field in json",
+			file:    "config.json",
+			content: `{"twitter": {"consumer_kye": "key"}}`,
+			err:     `unknown field "consumer_kye"`,
+		},
+		{
+			name:    "unknown field in yaml",
+			file:    "config.yml",
+			content: testConfigYAML + "redis_url: redis://localhost\n",
+			err:     `unknown field "redis_url"`,
+		},
+		{
+			name:    "invalid yaml",
+			file:    "config.yaml",
+			content: "twitter: [",
+			err:     "yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.file, tt.content)
+			config, err := LoadConfig(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("LoadConfig: err = %v, want containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(config) {
+				t.Errorf("LoadConfig = %+v", config)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	if _, err := LoadConfig("config.example.json"); err != nil {
+		t.Errorf("LoadConfig(config.example.json): %v", err)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", testConfigYAML)
+	setEnv(t, "TOMOBOTTER_TWITTER_CONSUMER_KEY", "env-key")
+	setEnv(t, "TOMOBOTTER_RATE_LIMIT_COMMANDS", `{"time": {"burst": 1, "interval": 5}}`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Twitter.ConsumerKey != "env-key" {
+		t.Errorf("twitter.consumer_key = %q, want the environment variable", config.Twitter.ConsumerKey)
+	}
+	// マップは要素ごとではなく、全体が置き換えられます。
+	if want := map[string]RateLimit{"time": {Burst: 1, Interval: 5}}; !reflect.DeepEqual(config.RateLimit.Commands, want) {
+		t.Errorf("rate_limit.commands = %+v, want %+v", config.RateLimit.Commands, want)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"TOMOBOTTER_TWITTER_ACCESS_TOKEN":     "token",
+		"TOMOBOTTER_REDIS_DB":                 " 3 ",
+		"TOMOBOTTER_MAINTENANCE":              "true",
+		"TOMOBOTTER_SERVER_ALLOW_ORIGINS":     "https://a.example, https://b.example,",
+		"TOMOBOTTER_SERVER_LISTENERS":         `[{"network": "tcp", "addr": ":8080"}]`,
+		"TOMOBOTTER_COMMANDS":                 `{"download": {"enabled": false}}`,
+		"TOMOBOTTER_PROFILE_MAINTENANCE_NAME": "{{.Name}}@メンテナンス中",
+		// 接頭辞のない変数は無視します。
+		"REDIS_DB": "5",
+	}
+	var config Config
+	errs := applyEnv(reflect.ValueOf(&config).Elem(), nil, func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+	if len(errs) != 0 {
+		t.Fatalf("applyEnv: %v", errs)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"twitter.access_token", config.Twitter.AccessToken, "token"},
+		{"redis.db", config.Redis.DB, 3},
+		{"maintenance", config.Maintenance, true},
+		{"server.allow_origins", config.Server.AllowOrigins, []string{"https://a.example", "https://b.example"}},
+		{"server.listeners", config.Server.Listeners, []ListenerConfig{{Network: "tcp", Addr: ":8080"}}},
+		{"commands.download.enabled", *config.Commands["download"].Enabled, false},
+		{"profile.maintenance.name", config.Profile.Maintenance.Name, "{{.Name}}@メンテナンス中"},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	env := map[string]string{
+		"TOMOBOTTER_REDIS_DB":           "one",
+		"TOMOBOTTER_MAINTENANCE":        "maybe",
+		"TOMOBOTTER_RATE_LIMIT_DEFAULT": "ignored",
+		"TOMOBOTTER_COMMANDS":           "{",
+	}
+	var config Config
+	errs := applyEnv(reflect.ValueOf(&config).Elem(), nil, func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+
+	// 構造体そのものは上書きできないため、TOMOBOTTER_RATE_LIMIT_DEFAULT は使われません。
+	want := []string{
+		"TOMOBOTTER_REDIS_DB:",
+		"TOMOBOTTER_COMMANDS: invalid JSON",
+		"TOMOBOTTER_MAINTENANCE:",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("applyEnv = %q, want %d errors", errs, len(want))
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(errs[i], prefix) {
+			t.Errorf("errs[%d] = %q, want prefix %q", i, errs[i], prefix)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		config := defaultConfig()
+		config.Twitter.ConsumerKey = "key"
+		config.Twitter.ConsumerSecret = "secret"
+		config.Twitter.AccessToken = "token"
+		config.Twitter.AccessTokenSecret = "token-secret"
+		config.Database.Driver = "sqlite"
+		config.SQLite.Path = ":memory:"
+		config.State.Driver = StateDriverMemory
+		return config
+	}
+	if errs := valid().validate(); len(errs) != 0 {
+		t.Fatalf("validate = %q, want no errors", errs)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{
+			name: "mysql and redis are required by default",
+			modify: func(c *Config) {
+				c.Database.Driver = ""
+				c.State.Driver = ""
+			},
+			want: []string{"mysql.db is required", "mysql.addr is required", "mysql.user is required", "redis.addr is required"},
+		},
+		{
+			name: "unknown drivers",
+			modify: func(c *Config) {
+				c.Database.Driver = "postgres"
+				c.State.Driver = "memcached"
+			},
+			want: []string{`database.driver must be mysql or sqlite: "postgres"`, `state.driver must be redis or memory: "memcached"`},
+		},
+		{
+			name: "commands",
+			modify: func(c *Config) {
+				c.Commands = map[string]CommandConfig{"dowload": {}}
+				c.RateLimit.Commands = map[string]RateLimit{"help": {Burst: 1}, "hlep": {}}
+			},
+			want: []string{
+				`commands: unknown command "dowload"`,
+				"rate_limit.commands.help.interval is required when burst is set",
+				`rate_limit.commands: unknown command "hlep"`,
+			},
+		},
+		{
+			name: "tweet budget",
+			modify: func(c *Config) {
+				c.TweetBudget.DailyLimit = 100
+				c.TweetBudget.NoticeReserve = 100
+				c.TweetBudget.DMFallbackReserve = -1
+			},
+			want: []string{
+				"tweet_budget.notice_reserve must be less than the daily limit 100: 100",
+				"tweet_budget.dm_fallback_reserve must not be negative: -1",
+			},
+		},
+		{
+			name: "every error at once",
+			modify: func(c *Config) {
+				c.Twitter.ConsumerKey = " "
+				c.Path.Webhook = "/"
+				c.Profile.Maintenance.Name = "{{.Name"
+				c.Log.Format = "xml"
+				c.Server.Listeners = []ListenerConfig{{Network: "tcp", Addr: ":8080", Mode: "0660"}}
+				c.Server.PublicURL = "bot.example"
+				c.ShutdownTimeout = -1
+			},
+			want: []string{
+				"twitter.consumer_key is required",
+				`path.webhook must be a path other than /: "/"`,
+				"profile.maintenance.name: template: profile:1: unclosed action",
+				`log.format must be json or text: "xml"`,
+				"server.listeners[0].mode is only available for unix sockets",
+				`server.public_url must be an http(s) URL: "bot.example"`,
+				"shutdown_timeout must not be negative: -1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(&config)
+			if errs := config.validate(); !reflect.DeepEqual([]string(errs), tt.want) {
+				t.Errorf("validate =\n  %s\nwant\n  %s", strings.Join(errs, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+		})
+	}
+}
+
+func TestLoadConfigReturnsAllErrors(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "state:\n  driver: memory\ndatabase:\n  driver: sqlite\n")
+	setEnv(t, "TOMOBOTTER_REDIS_DB", "one")
+
+	_, err := LoadConfig(path)
+	errs, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("LoadConfig: err = %v, want ConfigError", err)
+	}
+	// 環境変数の誤りと検証の誤りをまとめて返します。
+	if len(errs) != 6 || !strings.HasPrefix(errs[0], "TOMOBOTTER_REDIS_DB:") || errs[5] != "sqlite.path is required" {
+		t.Errorf("LoadConfig errors =\n  %s", strings.Join(errs, "\n  "))
+	}
+}
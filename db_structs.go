@@ -1,15 +1,86 @@
 package main
 
+import (
+	"strconv"
+	"time"
+)
+
+// Download はユーザーがダウンロードできるようにした動画です。ユーザーとツイートの組み合わせごとに一つ保存されます。
 type Download struct {
-	ScreenName     string `db:"screen_name, primarykey"`
-	VideoURL       string `db:"video_url"`
-	VideoThumbnail string `db:"video_thumbnail"`
-	TweetID        int64  `db:"tweet_id"`
+	// UserID はダウンロードを依頼したユーザーのIDです。ScreenName が変わっても同じユーザーの記録として扱うために使います。
+	// UserID を記録する前に保存されたものは0です。
+	UserID     int64
+	ScreenName string
+	TweetID    int64
+
+	// AuthorID と AuthorScreenName は動画をツイートしたユーザーです。
+	AuthorID         int64
+	AuthorScreenName string
+	Text             string
+
+	// MediaType は "video" か "animated_gif" です。
+	MediaType      string
+	DurationMillis int
+	// VideoURL と Bitrate は最もビットレートの高いMP4です。
+	VideoURL       string
+	Bitrate        int
+	VideoThumbnail string
+	Variants       []DownloadVariant
+
+	// RequestedAt はダウンロードを依頼された時間です。記録する前に保存されたものはゼロです。
+	RequestedAt time.Time
+}
+
+// DownloadVariant は動画のMP4の一つです。解像度はURLから分かる場合だけ設定されます。
+type DownloadVariant struct {
+	URL     string `json:"url"`
+	Bitrate int    `json:"bitrate"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
 }
 
 type DownloadResponse struct {
-	ScreenName     string `json:"screen_name,omitempty"`
-	VideoURL       string `json:"video_url"`
-	VideoThumbnail string `json:"video_thumbnail"`
-	TweetID        string `json:"tweet_id"`
+	ScreenName       string            `json:"screen_name,omitempty"`
+	UserID           string            `json:"user_id,omitempty"`
+	VideoURL         string            `json:"video_url"`
+	VideoThumbnail   string            `json:"video_thumbnail"`
+	TweetID          string            `json:"tweet_id"`
+	AuthorID         string            `json:"author_id,omitempty"`
+	AuthorScreenName string            `json:"author_screen_name,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	MediaType        string            `json:"media_type,omitempty"`
+	DurationMillis   int               `json:"duration_millis,omitempty"`
+	Bitrate          int               `json:"bitrate,omitempty"`
+	Variants         []DownloadVariant `json:"variants"`
+	RequestedAt      *time.Time        `json:"requested_at,omitempty"`
+}
+
+// newDownloadResponse はAPIで返す形にします。IDはJavaScriptで精度が落ちないように文字列にします。
+func newDownloadResponse(d Download) DownloadResponse {
+	res := DownloadResponse{
+		ScreenName:       d.ScreenName,
+		VideoURL:         d.VideoURL,
+		VideoThumbnail:   d.VideoThumbnail,
+		TweetID:          strconv.FormatInt(d.TweetID, 10),
+		AuthorScreenName: d.AuthorScreenName,
+		Text:             d.Text,
+		MediaType:        d.MediaType,
+		DurationMillis:   d.DurationMillis,
+		Bitrate:          d.Bitrate,
+		Variants:         d.Variants,
+	}
+	if d.UserID != 0 {
+		res.UserID = strconv.FormatInt(d.UserID, 10)
+	}
+	if d.AuthorID != 0 {
+		res.AuthorID = strconv.FormatInt(d.AuthorID, 10)
+	}
+	if res.Variants == nil {
+		res.Variants = []DownloadVariant{}
+	}
+	if !d.RequestedAt.IsZero() {
+		requestedAt := d.RequestedAt
+		res.RequestedAt = &requestedAt
+	}
+	return res
 }
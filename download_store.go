@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// DriverMySQL と DriverSQLite は database/sql のドライバーの名前です。
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite3"
+)
+
+// ErrDownloadExists は同じユーザーが同じツイートをすでに保存している場合のエラーです。
+var ErrDownloadExists = errors.New("download already exists")
+
+// DownloadStore はダウンロードできるようにした動画を保存します。
+type DownloadStore interface {
+	// Insert は d を保存します。同じユーザーとツイートの組み合わせがすでにある場合は ErrDownloadExists を返します。
+	// d.UserID が同じでスクリーンネームが異なる記録は、d.ScreenName に変更します。
+	Insert(d Download) error
+	// Delete はユーザーが保存したツイートを削除し、削除したかを返します。
+	// UserID を記録する前に保存されたものは screenName で探します。
+	Delete(userID int64, screenName string, tweetID int64) (bool, error)
+	// List はユーザーが保存したものを、依頼された時間の新しい順に返します。
+	List(screenName string) ([]Download, error)
+	// ListByUser は userID のユーザーが保存したものを List と同じ順に返します。
+	// UserID を記録する前に保存されたものは screenName で探します。
+	ListByUser(userID int64, screenName string) ([]Download, error)
+	// UserID は screenName で最後に保存したユーザーのIDを返します。見つからない場合は0です。
+	UserID(screenName string) (int64, error)
+	// SuggestScreenNames は query を含むスクリーンネームを limit 個まで返します。
+	SuggestScreenNames(query string, limit int) ([]string, error)
+	// Ping はデータベースに接続できるかを確かめます。
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// sqlDownloadStore は database/sql を使う DownloadStore です。データベースごとの違いは dialect で吸収します。
+type sqlDownloadStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+type sqlDialect struct {
+	// isDuplicate はエラーが主キーか一意キーの重複によるものかを返します。
+	isDuplicate func(err error) bool
+	// likeEscape は escape でエスケープしたLIKEのパターンに付ける ESCAPE 句です。
+	likeEscape string
+}
+
+// NewMySQLDownloadStore はMySQLに保存する DownloadStore を作成します。
+func NewMySQLDownloadStore(db *sql.DB) DownloadStore {
+	return &sqlDownloadStore{db: db, dialect: sqlDialect{
+		isDuplicate: func(err error) bool {
+			var mysqlErr *mysql.MySQLError
+			// https://dev.mysql.com/doc/refman/8.0/en/server-error-reference.html
+			return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 // ER_DUP_ENTRY
+		},
+	}}
+}
+
+// NewSQLiteDownloadStore はSQLiteに保存する DownloadStore を作成します。
+func NewSQLiteDownloadStore(db *sql.DB) DownloadStore {
+	return &sqlDownloadStore{db: db, dialect: sqlDialect{
+		isDuplicate: func(err error) bool {
+			var sqliteErr sqlite3.Error
+			return errors.As(err, &sqliteErr) &&
+				(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+		},
+		likeEscape: ` ESCAPE '\'`,
+	}}
+}
+
+// newDownloadStore はドライバーに合わせた DownloadStore を作成します。
+func newDownloadStore(driver string, db *sql.DB) (DownloadStore, error) {
+	switch driver {
+	case DriverMySQL:
+		return NewMySQLDownloadStore(db), nil
+	case DriverSQLite:
+		return NewSQLiteDownloadStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+func (s *sqlDownloadStore) Insert(d Download) error {
+	var variants sql.NullString
+	if len(d.Variants) > 0 {
+		b, err := json.Marshal(d.Variants)
+		if err != nil {
+			return err
+		}
+		variants = sql.NullString{String: string(b), Valid: true}
+	}
+	var requestedAt sql.NullTime
+	if !d.RequestedAt.IsZero() {
+		requestedAt = sql.NullTime{Time: d.RequestedAt.UTC(), Valid: true}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if d.UserID != 0 {
+		// Keep the history of users who have changed their screen name.
+		// A conflict means the user has saved the tweet under both names, so the old rows are left as they are.
+		_, err := tx.Exec("UPDATE download SET screen_name = ? WHERE user_id = ? AND screen_name <> ?", d.ScreenName, d.UserID, d.ScreenName)
+		if err != nil && !s.dialect.isDuplicate(err) {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO download (screen_name, tweet_id, video_url, video_thumbnail,
+	user_id, author_id, author_screen_name, tweet_text, media_type, duration_ms, bitrate, variants, requested_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ScreenName, d.TweetID, d.VideoURL, d.VideoThumbnail,
+		d.UserID, d.AuthorID, d.AuthorScreenName, d.Text, d.MediaType, d.DurationMillis, d.Bitrate, variants, requestedAt)
+	if err != nil {
+		if s.dialect.isDuplicate(err) {
+			return ErrDownloadExists
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlDownloadStore) Delete(userID int64, screenName string, tweetID int64) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM download WHERE tweet_id = ? AND (user_id = ? OR (user_id = 0 AND screen_name = ?))",
+		tweetID, userID, screenName)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const selectDownload = `SELECT screen_name, tweet_id, video_url, video_thumbnail,
+	user_id, author_id, author_screen_name, tweet_text, media_type, duration_ms, bitrate, variants, requested_at
+	FROM download`
+
+func (s *sqlDownloadStore) List(screenName string) ([]Download, error) {
+	return s.queryDownloads(selectDownload+` WHERE screen_name = ? ORDER BY requested_at DESC, tweet_id DESC`, screenName)
+}
+
+func (s *sqlDownloadStore) ListByUser(userID int64, screenName string) ([]Download, error) {
+	return s.queryDownloads(selectDownload+` WHERE user_id = ? OR (user_id = 0 AND screen_name = ?) ORDER BY requested_at DESC, tweet_id DESC`,
+		userID, screenName)
+}
+
+func (s *sqlDownloadStore) UserID(screenName string) (int64, error) {
+	var userID int64
+	err := s.db.QueryRow(`SELECT user_id FROM download WHERE screen_name = ? AND user_id <> 0 ORDER BY requested_at DESC, tweet_id DESC LIMIT 1`,
+		screenName).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+func (s *sqlDownloadStore) queryDownloads(query string, args ...interface{}) ([]Download, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var downloads []Download
+	for rows.Next() {
+		var (
+			d           Download
+			variants    sql.NullString
+			requestedAt sql.NullTime
+		)
+		if err := rows.Scan(&d.ScreenName, &d.TweetID, &d.VideoURL, &d.VideoThumbnail,
+			&d.UserID, &d.AuthorID, &d.AuthorScreenName, &d.Text, &d.MediaType, &d.DurationMillis, &d.Bitrate, &variants, &requestedAt); err != nil {
+			return nil, err
+		}
+		if variants.Valid && variants.String != "" {
+			if err := json.Unmarshal([]byte(variants.String), &d.Variants); err != nil {
+				return nil, fmt.Errorf("variants of download %d: %s", d.TweetID, err)
+			}
+		}
+		if requestedAt.Valid {
+			d.RequestedAt = requestedAt.Time.UTC()
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, rows.Err()
+}
+
+func (s *sqlDownloadStore) SuggestScreenNames(query string, limit int) ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT screen_name FROM download WHERE screen_name LIKE ?"+s.dialect.likeEscape+" LIMIT ?",
+		"%"+escape(query)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var screenNames []string
+	for rows.Next() {
+		var screenName string
+		if err := rows.Scan(&screenName); err != nil {
+			return nil, err
+		}
+		screenNames = append(screenNames, screenName)
+	}
+	return screenNames, rows.Err()
+}
+
+func (s *sqlDownloadStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlDownloadStore) Close() error {
+	return s.db.Close()
+}
+
+// openDB は設定されたデータベースに接続し、ドライバーの名前とともに返します。
+func openDB(config Config) (*sql.DB, string, error) {
+	switch config.Database.Driver {
+	case "", "mysql":
+		db, err := sql.Open(DriverMySQL, mysqlDSN(config))
+		return db, DriverMySQL, err
+	case "sqlite":
+		db, err := sql.Open(DriverSQLite, "file:"+config.SQLite.Path+"?_busy_timeout=5000")
+		if err != nil {
+			return nil, "", err
+		}
+		// SQLite allows only one writer, and each connection to :memory: is another database.
+		db.SetMaxOpenConns(1)
+		return db, DriverSQLite, nil
+	default:
+		return nil, "", fmt.Errorf("unknown database driver %q", config.Database.Driver)
+	}
+}
+
+// mysqlDSN はMySQLに接続するためのDSNを返します。
+// Addr は unix(/path/to/mysql.sock) や tcp(host:port) の形式か、ソケットのパス、host:port で指定します。
+func mysqlDSN(config Config) string {
+	c := mysql.NewConfig()
+	c.User = config.MySQL.User
+	c.Passwd = config.MySQL.Password
+	c.DBName = config.MySQL.DB
+	c.ParseTime = true
+
+	addr := config.MySQL.Addr
+	switch {
+	case strings.HasSuffix(addr, ")") && strings.Contains(addr, "("):
+		i := strings.Index(addr, "(")
+		c.Net, c.Addr = addr[:i], addr[i+1:len(addr)-1]
+	case strings.HasPrefix(addr, "/"):
+		c.Net, c.Addr = "unix", addr
+	default:
+		c.Net, c.Addr = "tcp", addr
+	}
+	return c.FormatDSN()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestDownloadStore はマイグレーションを適用した空のSQLiteのデータベースを :memory: に作成します。
+func newTestDownloadStore(t *testing.T) DownloadStore {
+	t.Helper()
+	var config Config
+	config.Database.Driver = "sqlite"
+	config.SQLite.Path = ":memory:"
+	store, err := replayDownloadStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func listTweetIDs(t *testing.T, store DownloadStore, screenName string) []int64 {
+	t.Helper()
+	downloads, err := store.List(screenName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	for _, d := range downloads {
+		ids = append(ids, d.TweetID)
+	}
+	return ids
+}
+
+func TestDownloadStoreInsert(t *testing.T) {
+	store := newTestDownloadStore(t)
+	requestedAt := time.Date(2020, 5, 24, 12, 0, 0, 0, time.UTC)
+	want := Download{
+		UserID:           10,
+		ScreenName:       "alice",
+		TweetID:          100,
+		AuthorID:         20,
+		AuthorScreenName: "bob",
+		Text:             "video",
+		MediaType:        "video",
+		DurationMillis:   1500,
+		VideoURL:         "https://video.twimg.com/ext_tw_video/100/pu/vid/1280x720/a.mp4",
+		Bitrate:          2176000,
+		VideoThumbnail:   "https://pbs.twimg.com/ext_tw_video_thumb/100/pu/img/a.jpg",
+		Variants: []DownloadVariant{
+			{URL: "https://video.twimg.com/ext_tw_video/100/pu/vid/1280x720/a.mp4", Bitrate: 2176000, Width: 1280, Height: 720},
+		},
+		RequestedAt: requestedAt,
+	}
+	if err := store.Insert(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("List = %+v, want [%+v]", got, want)
+	}
+}
+
+func TestDownloadStoreInsertDuplicate(t *testing.T) {
+	store := newTestDownloadStore(t)
+	d := Download{UserID: 10, ScreenName: "alice", TweetID: 100}
+	if err := store.Insert(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(d); err != ErrDownloadExists {
+		t.Errorf("Insert the same download: err = %v, want ErrDownloadExists", err)
+	}
+	// 別のユーザーは同じツイートを保存できます。
+	if err := store.Insert(Download{UserID: 11, ScreenName: "carol", TweetID: 100}); err != nil {
+		t.Errorf("Insert by another user: %v", err)
+	}
+}
+
+func TestDownloadStoreInsertRenamed(t *testing.T) {
+	store := newTestDownloadStore(t)
+	if err := store.Insert(Download{UserID: 10, ScreenName: "alice", TweetID: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(Download{UserID: 10, ScreenName: "alice2", TweetID: 101}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := listTweetIDs(t, store, "alice"); len(ids) != 0 {
+		t.Errorf("List(old name) = %v, want none", ids)
+	}
+	if ids, want := listTweetIDs(t, store, "alice2"), []int64{101, 100}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List(new name) = %v, want %v", ids, want)
+	}
+}
+
+func TestDownloadStoreDelete(t *testing.T) {
+	store := newTestDownloadStore(t)
+	for _, d := range []Download{
+		{UserID: 10, ScreenName: "alice", TweetID: 100},
+		// UserID を記録する前に保存されたものです。
+		{ScreenName: "alice", TweetID: 101},
+		{UserID: 11, ScreenName: "carol", TweetID: 100},
+	} {
+		if err := store.Insert(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		userID     int64
+		screenName string
+		tweetID    int64
+		want       bool
+	}{
+		{10, "alice", 100, true},
+		{10, "alice", 100, false},
+		{10, "alice", 101, true},
+		{10, "alice", 102, false},
+	}
+	for _, tt := range tests {
+		deleted, err := store.Delete(tt.userID, tt.screenName, tt.tweetID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != tt.want {
+			t.Errorf("Delete(%d, %q, %d) = %v, want %v", tt.userID, tt.screenName, tt.tweetID, deleted, tt.want)
+		}
+	}
+	if ids, want := listTweetIDs(t, store, "carol"), []int64{100}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List(other user) = %v, want %v", ids, want)
+	}
+}
+
+func TestDownloadStoreListOrder(t *testing.T) {
+	store := newTestDownloadStore(t)
+	base := time.Date(2020, 5, 24, 12, 0, 0, 0, time.UTC)
+	for _, d := range []Download{
+		{ScreenName: "alice", TweetID: 100, RequestedAt: base},
+		{ScreenName: "alice", TweetID: 101, RequestedAt: base.Add(time.Hour)},
+		{ScreenName: "alice", TweetID: 102, RequestedAt: base.Add(-time.Hour)},
+		// 依頼された時間が同じ場合はツイートの新しい順です。
+		{ScreenName: "alice", TweetID: 103, RequestedAt: base},
+		// 依頼された時間を記録する前に保存されたものは最後です。
+		{ScreenName: "alice", TweetID: 104},
+	} {
+		if err := store.Insert(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids, want := listTweetIDs(t, store, "alice"), []int64{101, 103, 100, 102, 104}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List = %v, want %v", ids, want)
+	}
+}
+
+func TestDownloadStoreSuggestScreenNames(t *testing.T) {
+	store := newTestDownloadStore(t)
+	for i, screenName := range []string{"a_b", "axb", "a%b", "a\\b", "abc", "abc"} {
+		if err := store.Insert(Download{ScreenName: screenName, TweetID: int64(100 + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"a_", []string{"a_b"}},
+		{"a%", []string{"a%b"}},
+		{"a\\", []string{"a\\b"}},
+		{"bc", []string{"abc"}},
+		{"zz", nil},
+	}
+	for _, tt := range tests {
+		got, err := store.SuggestScreenNames(tt.query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SuggestScreenNames(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	if got, err := store.SuggestScreenNames("a", 2); err != nil || len(got) != 2 {
+		t.Errorf("SuggestScreenNames with limit 2 = %q, %v", got, err)
+	}
+}
+
+func TestDownloadStoreListByUser(t *testing.T) {
+	store := newTestDownloadStore(t)
+	base := time.Date(2020, 5, 24, 12, 0, 0, 0, time.UTC)
+	for _, d := range []Download{
+		// alice は alice2 に名前を変え、その後 carol が alice を使い始めました。
+		{ScreenName: "alice", TweetID: 100},
+		{UserID: 10, ScreenName: "alice", TweetID: 101, RequestedAt: base},
+		{UserID: 10, ScreenName: "alice2", TweetID: 102, RequestedAt: base.Add(time.Hour)},
+		{UserID: 11, ScreenName: "alice", TweetID: 103, RequestedAt: base.Add(2 * time.Hour)},
+	} {
+		if err := store.Insert(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		screenName string
+		want       int64
+	}{
+		{"alice", 11},
+		{"alice2", 10},
+		{"bob", 0},
+	}
+	for _, tt := range tests {
+		if userID, err := store.UserID(tt.screenName); err != nil || userID != tt.want {
+			t.Errorf("UserID(%q) = %d, %v, want %d", tt.screenName, userID, err, tt.want)
+		}
+	}
+
+	downloads, err := store.ListByUser(10, "alice2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, d := range downloads {
+		ids = append(ids, d.TweetID)
+	}
+	if want := []int64{102, 101}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListByUser(10) = %v, want %v", ids, want)
+	}
+}
+
+func TestDownloadStoreInsertDuplicateAcrossScreenNames(t *testing.T) {
+	store := newTestDownloadStore(t)
+	// 別のユーザーが alice2 として 101 を保存しているため、alice の記録は alice2 に変更できずに残ります。
+	for _, d := range []Download{
+		{UserID: 10, ScreenName: "alice", TweetID: 100},
+		{UserID: 10, ScreenName: "alice", TweetID: 101},
+		{ScreenName: "alice2", TweetID: 101},
+	} {
+		if err := store.Insert(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Insert(Download{UserID: 10, ScreenName: "alice2", TweetID: 100}); err != ErrDownloadExists {
+		t.Errorf("Insert under the new screen name: err = %v, want ErrDownloadExists", err)
+	}
+}
+
+func TestMigrateUserTweetUnique(t *testing.T) {
+	db, err := sql.Open(DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	if _, err := MigrateUp(db, DriverSQLite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateDown(db, DriverSQLite, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 一意キーがない間に、名前を変えたユーザーが同じツイートを保存したものです。
+	store := NewSQLiteDownloadStore(db)
+	base := time.Date(2020, 5, 24, 12, 0, 0, 0, time.UTC)
+	for _, d := range []Download{
+		{UserID: 10, ScreenName: "alice", TweetID: 100, RequestedAt: base},
+		{ScreenName: "bob", TweetID: 100},
+		{ScreenName: "carol", TweetID: 100},
+	} {
+		if err := store.Insert(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Insert は先に名前を変更するため、直接追加します。
+	if _, err := db.Exec(`INSERT INTO download (screen_name, tweet_id, video_url, video_thumbnail, user_id, requested_at)
+	VALUES ('alice2', 100, '', '', 10, ?)`, base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateUp(db, DriverSQLite); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := listTweetIDs(t, store, "alice"); len(ids) != 0 {
+		t.Errorf("List(alice) = %v, want the older duplicate removed", ids)
+	}
+	if ids, want := listTweetIDs(t, store, "alice2"), []int64{100}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List(alice2) = %v, want %v", ids, want)
+	}
+	if ids, want := listTweetIDs(t, store, "carol"), []int64{100}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List(carol) = %v, want %v", ids, want)
+	}
+}
@@ -8,13 +8,11 @@ require (
 	github.com/armon/go-radix v1.0.0 // indirect
 	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
-	github.com/deckarep/golang-set v1.7.1
 	github.com/dghubble/oauth1 v0.6.0
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/getsentry/sentry-go v0.6.1
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-gonic/gin v1.6.3
-	github.com/go-gorp/gorp v2.2.0+incompatible
 	github.com/go-playground/validator/v10 v10.3.0 // indirect
 	github.com/go-redis/redis v6.15.8+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
@@ -24,12 +22,13 @@ require (
 	github.com/jmank88/nuts v0.4.0 // indirect
 	github.com/kyokomi/lottery v1.2.0
 	github.com/lib/pq v1.4.0 // indirect
-	github.com/mattn/go-sqlite3 v2.0.3+incompatible // indirect
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/nightlyone/lockfile v1.0.0 // indirect
 	github.com/poy/onpar v0.0.0-20200406201722-06f95a1c68e8 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sdboyer/constext v0.0.0-20170321163424-836a14457353 // indirect
+	github.com/sirupsen/logrus v1.6.0
 	github.com/tomocrafter/go-twitter v0.0.0-20200524032136-e236ea578c8e
 	github.com/ziutek/mymysql v1.5.4 // indirect
-	golang.org/x/sys v0.0.0-20200523222454-059865788121 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
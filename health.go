@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version はビルドするときに -ldflags "-X main.version=..." で設定されるバージョンです。
+var version = "dev"
+
+var startedAt = time.Now()
+
+const (
+	// healthCheckTimeout はデータベースとRedisの確認を待つ最大の時間です。
+	healthCheckTimeout = 3 * time.Second
+	// credentialsCheckInterval はTwitterの認証情報を確認し直す間隔です。
+	// APIの回数制限を消費しないように、それまでは前回の結果を返します。
+	credentialsCheckInterval = time.Minute
+)
+
+const (
+	healthOK       = "ok"
+	healthDown     = "down"
+	healthDisabled = "disabled"
+)
+
+// BuildInfo は実行しているBotのバージョンです。
+type BuildInfo struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func buildInfo() BuildInfo {
+	return BuildInfo{Version: version, GoVersion: runtime.Version(), StartedAt: startedAt}
+}
+
+// HealthCheck は依存しているサービスの一つを確認した結果です。
+type HealthCheck struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+func newHealthCheck(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: healthDown, Error: err.Error()}
+	}
+	return HealthCheck{Status: healthOK}
+}
+
+// Readiness は /readyz のレスポンスです。
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+	Queues struct {
+		Lookup   int `json:"lookup"`
+		Outbound int `json:"outbound"`
+	} `json:"queues"`
+	NoReply struct {
+		Blocked bool       `json:"blocked"`
+		Until   *time.Time `json:"until,omitempty"`
+	} `json:"no_reply"`
+	// RateLimits はエンドポイントごとのAPIの残りの回数です。まだ分からないエンドポイントは含まれません。
+	RateLimits map[string]RateLimitState `json:"rate_limits"`
+	Build      BuildInfo                 `json:"build"`
+}
+
+// RateLimitState はAPIの残りの回数と、それが回復する時間です。
+type RateLimitState struct {
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	Exhausted bool      `json:"exhausted"`
+}
+
+// credentialsCheck はTwitterの認証情報を確認した結果を、credentialsCheckInterval の間保持します。
+// 確認し直すときはバックグラウンドで行い、その間は前回の結果を返します。
+type credentialsCheck struct {
+	api TwitterAPI
+	id  int64
+
+	mu         sync.Mutex
+	checkedAt  time.Time
+	err        error
+	refreshing chan struct{}
+}
+
+func (c *credentialsCheck) check(now time.Time) HealthCheck {
+	c.mu.Lock()
+	if c.refreshing == nil && (c.checkedAt.IsZero() || now.Sub(c.checkedAt) >= credentialsCheckInterval) {
+		c.refreshing = make(chan struct{})
+		go c.refresh(now, c.refreshing)
+	}
+	refreshing, checked := c.refreshing, !c.checkedAt.IsZero()
+	c.mu.Unlock()
+
+	// まだ一度も確認していない場合だけ、結果を待ちます。
+	if !checked {
+		<-refreshing
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := newHealthCheck(c.err)
+	checkedAt := c.checkedAt
+	result.CheckedAt = &checkedAt
+	return result
+}
+
+func (c *credentialsCheck) refresh(now time.Time, done chan struct{}) {
+	defer close(done)
+	user, _, err := c.api.VerifyCredentials()
+	if err == nil && user.ID != c.id {
+		err = errors.New("logged in as another account: " + user.ScreenName)
+	}
+	c.mu.Lock()
+	c.checkedAt, c.err, c.refreshing = now, err, nil
+	c.mu.Unlock()
+}
+
+// isStopping は終了を始めてWebhookの受け付けを止めているかを返します。
+func (b *Bot) isStopping() bool {
+	select {
+	case <-b.stopListening:
+		return true
+	default:
+		return false
+	}
+}
+
+// healthzHandler は /healthz のハンドラーです。プロセスが動作しているかだけを返し、依存しているサービスは確認しません。
+func (b *Bot) healthzHandler() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		status, code := healthOK, http.StatusOK
+		if b.isStopping() {
+			status, code = "stopping", http.StatusServiceUnavailable
+		}
+		context.JSON(code, gin.H{
+			"status":      status,
+			"screen_name": b.ScreenName,
+			"uptime":      time.Since(startedAt).Seconds(),
+			"build":       buildInfo(),
+		})
+	}
+}
+
+// readyzHandler は /readyz のハンドラーです。
+// データベース、Redis、Twitterの認証情報のいずれかを利用できない場合と、終了を始めた後は 503 を返します。
+func (b *Bot) readyzHandler() gin.HandlerFunc {
+	credentials := &credentialsCheck{api: b.Twitter, id: b.ID}
+	return func(context *gin.Context) {
+		readiness := b.readiness(context.Request.Context(), credentials)
+		code := http.StatusOK
+		if readiness.Status != healthOK {
+			code = http.StatusServiceUnavailable
+		}
+		context.JSON(code, readiness)
+	}
+}
+
+func (b *Bot) readiness(ctx context.Context, credentials *credentialsCheck) Readiness {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	// 確認は並行して行い、healthCheckTimeout までに終わらなかったものは down として返します。
+	var names []string
+	results := make(map[string]chan HealthCheck)
+	run := func(name string, check func() HealthCheck) {
+		result := make(chan HealthCheck, 1)
+		names = append(names, name)
+		results[name] = result
+		go func() {
+			result <- check()
+		}()
+	}
+	run("database", func() HealthCheck {
+		if b.Downloads == nil {
+			return HealthCheck{Status: healthDisabled}
+		}
+		return newHealthCheck(b.Downloads.Ping(ctx))
+	})
+	run("redis", func() HealthCheck {
+		if b.Redis == nil {
+			return HealthCheck{Status: healthDisabled}
+		}
+		return newHealthCheck(b.Redis.WithContext(ctx).Ping().Err())
+	})
+	run("twitter", func() HealthCheck {
+		return credentials.check(b.now())
+	})
+	checks := make(map[string]HealthCheck, len(names))
+	for _, name := range names {
+		select {
+		case check := <-results[name]:
+			checks[name] = check
+		case <-ctx.Done():
+			checks[name] = HealthCheck{Status: healthDown, Error: "timeout"}
+		}
+	}
+
+	var r Readiness
+	r.Status = healthOK
+	if b.isStopping() {
+		r.Status = "stopping"
+	}
+	for _, check := range checks {
+		if check.Status == healthDown {
+			r.Status = healthDown
+		}
+	}
+	r.Checks = checks
+
+	r.Queues.Lookup = b.lookupQueue.Len()
+	if n, err := b.outbound.Len(); err == nil {
+		r.Queues.Outbound = n
+	} else {
+		r.Queues.Outbound = -1
+	}
+
+	if until := b.noReplyUntil(); !until.IsZero() {
+		r.NoReply.Blocked = true
+		r.NoReply.Until = &until
+	}
+
+	now := b.now()
+	r.RateLimits = make(map[string]RateLimitState)
+	for _, endpoint := range []string{EndpointStatusesLookup, EndpointStatusesShow} {
+		if budget, err := b.lookupQueue.budgets.Get(endpoint, now); err == nil && budget.Known() {
+			r.RateLimits[endpoint] = RateLimitState{
+				Remaining: budget.Remaining,
+				Reset:     budget.Reset,
+				Exhausted: budget.Exhausted(now),
+			}
+		}
+	}
+
+	r.Build = buildInfo()
+	return r
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// verifyingTwitterClient は VerifyCredentials が呼ばれた回数を数え、release が閉じられるまで待たせます。
+type verifyingTwitterClient struct {
+	*FakeTwitterClient
+
+	mu      sync.Mutex
+	calls   int
+	release chan struct{}
+}
+
+func (c *verifyingTwitterClient) VerifyCredentials() (*twitter.User, *http.Response, error) {
+	c.mu.Lock()
+	c.calls++
+	release := c.release
+	c.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return c.FakeTwitterClient.VerifyCredentials()
+}
+
+func (c *verifyingTwitterClient) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func (c *verifyingTwitterClient) block() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release = make(chan struct{})
+	return c.release
+}
+
+func TestCredentialsCheckRefreshInBackground(t *testing.T) {
+	clock := newTestClock()
+	api := &verifyingTwitterClient{FakeTwitterClient: NewFakeTwitterClient(replayBotUser)}
+	c := &credentialsCheck{api: api, id: replayBotUser.ID}
+
+	// 最初の確認だけは結果を待ちます。
+	first := c.check(clock.now())
+	if first.Status != healthOK || !first.CheckedAt.Equal(clock.now()) {
+		t.Errorf("first check = %+v", first)
+	}
+
+	clock.advance(credentialsCheckInterval - time.Second)
+	if check := c.check(clock.now()); !check.CheckedAt.Equal(*first.CheckedAt) || api.Calls() != 1 {
+		t.Errorf("check within the interval = %+v after %d calls, want the cached result", check, api.Calls())
+	}
+
+	// 確認し直している間は、待たずに前回の結果を返します。
+	release := api.block()
+	clock.advance(time.Second)
+	refreshedAt := clock.now()
+	if check := c.check(refreshedAt); !check.CheckedAt.Equal(*first.CheckedAt) {
+		t.Errorf("check while refreshing = %+v, want the previous result", check)
+	}
+	clock.advance(time.Second)
+	c.check(clock.now())
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		check := c.check(clock.now())
+		if check.CheckedAt.Equal(refreshedAt) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("check = %+v, want refreshed at %s", check, refreshedAt)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := api.Calls(); n != 2 {
+		t.Errorf("VerifyCredentials called %d times, want 2", n)
+	}
+}
+
+func TestCredentialsCheckAnotherAccount(t *testing.T) {
+	api := &verifyingTwitterClient{FakeTwitterClient: NewFakeTwitterClient(testUser)}
+	c := &credentialsCheck{api: api, id: replayBotUser.ID}
+	if check := c.check(newTestClock().now()); check.Status != healthDown || check.Error == "" {
+		t.Errorf("check logged in as another account = %+v, want down", check)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	api := &verifyingTwitterClient{FakeTwitterClient: NewFakeTwitterClient(replayBotUser)}
+	release := api.block()
+	defer close(release)
+	bot, err := NewBot(Config{}, Dependencies{Twitter: api.FakeTwitterClient, Downloads: newTestDownloadStore(t), Now: newTestClock().now})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := bot.readiness(ctx, &credentialsCheck{api: api, id: replayBotUser.ID})
+	if r.Status != healthDown {
+		t.Errorf("Status = %q, want down", r.Status)
+	}
+	want := map[string]HealthCheck{
+		"database": {Status: healthOK},
+		"redis":    {Status: healthDisabled},
+		"twitter":  {Status: healthDown, Error: "timeout"},
+	}
+	for name, check := range want {
+		if got := r.Checks[name]; got.Status != check.Status || got.Error != check.Error {
+			t.Errorf("Checks[%s] = %+v, want %+v", name, got, check)
+		}
+	}
+}
+
+func TestHealthHandlersWhileStopping(t *testing.T) {
+	fake := NewFakeTwitterClient(replayBotUser)
+	bot := newTestBot(t, Config{}, fake, newTestClock())
+	healthz, readyz := bot.healthzHandler(), bot.readyzHandler()
+
+	serve := func(handler gin.HandlerFunc) (int, string) {
+		w := httptest.NewRecorder()
+		context, _ := gin.CreateTestContext(w)
+		context.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		handler(context)
+		var body struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, body.Status
+	}
+
+	for name, handler := range map[string]gin.HandlerFunc{"healthz": healthz, "readyz": readyz} {
+		if code, status := serve(handler); code != http.StatusOK || status != healthOK {
+			t.Errorf("%s = %d %q, want 200 ok", name, code, status)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bot.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, handler := range map[string]gin.HandlerFunc{"healthz": healthz, "readyz": readyz} {
+		if code, status := serve(handler); code != http.StatusServiceUnavailable || status != "stopping" {
+			t.Errorf("%s while stopping = %d %q, want 503 stopping", name, code, status)
+		}
+	}
+}
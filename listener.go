@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSocketPath = "/var/run/twitter/bot.sock"
+	defaultPublicURL  = "https://bot.tomocraft.net"
+)
+
+// ListenerConfig はHTTPサーバーが待ち受けるアドレスの設定です。
+type ListenerConfig struct {
+	// Network は "unix" か "tcp" です。
+	Network string `json:"network"`
+	// Addr はunixソケットのパスか、host:port です。
+	Addr string `json:"addr"`
+	// Mode はunixソケットのパーミッションを8進数で指定します。空の場合は変更しません。
+	Mode string `json:"mode"`
+	// TLS の CertFile と KeyFile が指定されている場合はHTTPSで待ち受けます。
+	TLS struct {
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+	} `json:"tls"`
+}
+
+func (l ListenerConfig) useTLS() bool {
+	return l.TLS.CertFile != "" || l.TLS.KeyFile != ""
+}
+
+func (l ListenerConfig) String() string {
+	scheme := "http"
+	if l.useTLS() {
+		scheme = "https"
+	}
+	return scheme + "+" + l.Network + "://" + l.Addr
+}
+
+// listeners は待ち受けるアドレスを返します。指定されていない場合は /var/run/twitter/bot.sock で待ち受けます。
+func (c Config) listeners() []ListenerConfig {
+	if len(c.Server.Listeners) > 0 {
+		return c.Server.Listeners
+	}
+	return []ListenerConfig{{Network: "unix", Addr: defaultSocketPath}}
+}
+
+// allowOrigins はCORSで許可するオリジンを返します。
+func (c Config) allowOrigins() []string {
+	if len(c.Server.AllowOrigins) > 0 {
+		return c.Server.AllowOrigins
+	}
+	return []string{defaultPublicURL}
+}
+
+// publicURL はダウンロードページなどの公開されているURLの、末尾の / を除いたものを返します。
+func (c Config) publicURL() string {
+	if c.Server.PublicURL != "" {
+		return strings.TrimRight(c.Server.PublicURL, "/")
+	}
+	return defaultPublicURL
+}
+
+// listen は設定されたアドレスで待ち受けます。unixソケットのファイルは Close したときに削除されます。
+func listen(config ListenerConfig) (net.Listener, error) {
+	switch config.Network {
+	case "unix":
+		// Remove the socket left by the previous process.
+		if info, err := os.Stat(config.Addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(config.Addr); err != nil {
+				return nil, err
+			}
+		}
+		l, err := net.Listen("unix", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if config.Mode != "" {
+			mode, err := strconv.ParseUint(config.Mode, 8, 32)
+			if err != nil {
+				l.Close()
+				return nil, fmt.Errorf("invalid mode %q of %s: %s", config.Mode, config.Addr, err)
+			}
+			if err := os.Chmod(config.Addr, os.FileMode(mode)); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		return l, nil
+	case "tcp":
+		return net.Listen("tcp", config.Addr)
+	default:
+		return nil, fmt.Errorf("unknown network %q", config.Network)
+	}
+}
+
+// serve は server をすべての listeners で待ち受けます。
+// いずれかの待ち受けが server.Shutdown 以外の理由で止まった場合はエラーを errs に送ります。
+func serve(server *http.Server, listeners []net.Listener, configs []ListenerConfig, errs chan<- error) {
+	for i, l := range listeners {
+		go func(l net.Listener, config ListenerConfig) {
+			var err error
+			if config.useTLS() {
+				err = server.ServeTLS(l, config.TLS.CertFile, config.TLS.KeyFile)
+			} else {
+				err = server.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("%s: %s", config, err)
+			}
+		}(l, configs[i])
+	}
+}
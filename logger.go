@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// logger はBot全体で使うログの出力先です。
+var logger = &logrus.Logger{
+	Out:       os.Stderr,
+	Formatter: &logrus.JSONFormatter{},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+}
+
+// redactedText は記録しないダイレクトメッセージの本文の代わりに記録する文字列です。
+const redactedText = "[REDACTED]"
+
+// configureLogger はログのレベルと形式を設定します。
+// Level が空の場合は info、Format が "text" の場合は人が読みやすい形式で出力します。
+func configureLogger(config Config) error {
+	level := logrus.InfoLevel
+	if config.Log.Level != "" {
+		l, err := logrus.ParseLevel(config.Log.Level)
+		if err != nil {
+			return err
+		}
+		level = l
+	}
+	logger.SetLevel(level)
+
+	if config.Log.Format == "text" {
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	} else {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+	return nil
+}
+
+// newCorrelationID は受信したイベントごとのIDを作成します。
+// ログとSentryで同じイベントによるものをまとめるために使います。
+func newCorrelationID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// correlationID はログのフィールドからイベントのIDを返します。
+func correlationID(entry *logrus.Entry) string {
+	if entry == nil {
+		return ""
+	}
+	id, _ := entry.Data["correlation_id"].(string)
+	return id
+}
+
+// requestLogger は gin.Logger() の代わりにリクエストを記録するミドルウェアです。
+func requestLogger() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		start := time.Now()
+		context.Next()
+
+		entry := logger.WithFields(logrus.Fields{
+			"method":    context.Request.Method,
+			"path":      context.Request.URL.Path,
+			"status":    context.Writer.Status(),
+			"latency":   time.Since(start).Seconds(),
+			"client_ip": context.ClientIP(),
+		})
+		if id := context.GetString("correlation_id"); id != "" {
+			entry = entry.WithField("correlation_id", id)
+		}
+		if len(context.Errors) > 0 {
+			entry.Error(context.Errors.String())
+		} else {
+			entry.Info("request")
+		}
+	}
+}
+
+// redactWebhookBody はWebhookのペイロードからダイレクトメッセージの本文を取り除きます。
+// JSONとして読み込めない場合は本文を記録しないように、空の文字列を返します。
+func redactWebhookBody(body []byte) string {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+
+	events, _ := payload["direct_message_events"].([]interface{})
+	for _, event := range events {
+		data := nestedMap(event, "message_create", "message_data")
+		if data == nil {
+			continue
+		}
+		if _, ok := data["text"]; ok {
+			data["text"] = redactedText
+		}
+		if _, ok := data["entities"]; ok {
+			delete(data, "entities") // URLs and mentions are part of the text.
+		}
+		if quick := nestedMap(data, "quick_reply_response"); quick != nil {
+			if _, ok := quick["metadata"]; ok {
+				quick["metadata"] = redactedText
+			}
+		}
+	}
+
+	redacted, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	return string(redacted)
+}
+
+func nestedMap(v interface{}, keys ...string) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	for _, key := range keys {
+		if m == nil {
+			return nil
+		}
+		m, _ = m[key].(map[string]interface{})
+	}
+	return m
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedactWebhookBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "direct message",
+			body: `{"for_user_id": "1000", "direct_message_events": [{"type": "message_create", "id": "3000", "message_create": {
+				"target": {"recipient_id": "1000"}, "sender_id": "2000",
+				"message_data": {"text": "secret https://t.co/a", "entities": {"urls": [{"url": "https://t.co/a"}]},
+					"quick_reply_response": {"type": "options", "metadata": "secret"}}}}]}`,
+			want: `{"for_user_id": "1000", "direct_message_events": [{"type": "message_create", "id": "3000", "message_create": {
+				"target": {"recipient_id": "1000"}, "sender_id": "2000",
+				"message_data": {"text": "[REDACTED]", "quick_reply_response": {"type": "options", "metadata": "[REDACTED]"}}}}]}`,
+		},
+		{
+			name: "every direct message",
+			body: `{"direct_message_events": [
+				{"message_create": {"message_data": {"text": "a"}}},
+				{"message_create": {"message_data": {"text": "b"}}}]}`,
+			want: `{"direct_message_events": [
+				{"message_create": {"message_data": {"text": "[REDACTED]"}}},
+				{"message_create": {"message_data": {"text": "[REDACTED]"}}}]}`,
+		},
+		{
+			name: "direct message without data",
+			body: `{"direct_message_events": [{"type": "message_create"}], "direct_message_indicate_typing_events": [{"sender_id": "2000"}]}`,
+			want: `{"direct_message_events": [{"type": "message_create"}], "direct_message_indicate_typing_events": [{"sender_id": "2000"}]}`,
+		},
+		{
+			// ツイートは公開されているため、そのまま記録します。
+			name: "tweet",
+			body: `{"for_user_id": "1000", "tweet_create_events": [{"id_str": "500", "text": "@tomobotter time"}]}`,
+			want: `{"for_user_id": "1000", "tweet_create_events": [{"id_str": "500", "text": "@tomobotter time"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactWebhookBody([]byte(tt.body))
+			var gotJSON, wantJSON interface{}
+			if err := json.Unmarshal([]byte(got), &gotJSON); err != nil {
+				t.Fatalf("redactWebhookBody = %q: %v", got, err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotJSON, wantJSON) {
+				t.Errorf("redactWebhookBody =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactWebhookBodyInvalid(t *testing.T) {
+	// 本文を記録しないように、JSONのオブジェクトとして読み込めないものは何も記録しません。
+	for _, body := range []string{
+		"",
+		"text=secret",
+		`{"direct_message_events": [{"message_create": {"message_data": {"text": "secret"`,
+		`["secret"]`,
+	} {
+		if got := redactWebhookBody([]byte(body)); got != "" {
+			t.Errorf("redactWebhookBody(%q) = %q, want empty", body, got)
+		}
+	}
+}
@@ -1,42 +1,30 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"database/sql"
-	"encoding/json"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/gin-contrib/cors"
 
-	"github.com/dghubble/oauth1"
 	"github.com/gin-gonic/gin"
-	"github.com/go-gorp/gorp"
-	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
 var (
 	location = time.FixedZone("Asia/Tokyo", 9*60*60)
 
-	botConfig      Config
-	id             int64
-	dbMap          *gorp.DbMap
-	client         *twitter.Client
-	redisClient    *redis.Client
-	deniedClients  []string
-	queueProcessor *lookupQueue
-
 	// Error
 	errNotVideoTweet = errors.New("動画やgifのツイートにリプライしてください。")
 	errNoMediaFound  = errors.New("動画やgifのツイートにリプライしてください。また、現在、企業向けのツイートメイカーにて作成されたツイートの動画をダウンロードすることはできません。")
@@ -44,26 +32,16 @@ var (
 
 const (
 	// Redis Key
-	NoReply            = "no-reply-id"
-	ShowRateLimitReset = "show-rate-limit-reset"
+	NoReply = "no-reply-id"
 )
 
-func init() {
-	go loadDeniedClientList()
-	file, err := ioutil.ReadFile("config.json")
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(file, &botConfig)
-	if err != nil {
-		panic(err)
-	}
-}
+// deniedClientsPath は拒否するクライアントの一覧のファイルです。1行に1つのクライアント名を書きます。
+const deniedClientsPath = "denied_clients.txt"
 
 func escape(target string) string {
 	var sb strings.Builder
 	for _, v := range target {
-		if v == '_' || v == '%' {
+		if v == '_' || v == '%' || v == '\\' {
 			sb.WriteByte('\\')
 		}
 		sb.WriteRune(v)
@@ -71,42 +49,30 @@ func escape(target string) string {
 	return sb.String()
 }
 
-func loadDeniedClientList() {
-	fp, err := os.OpenFile("denied_clients.txt", os.O_RDONLY|os.O_CREATE, 0660)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer fp.Close()
+func main() {
+	configPath := flag.String("config", "config.json", "path to the config file (.json, .yaml or .yml); empty to use only environment variables")
+	flag.Parse()
 
-	scanner := bufio.NewScanner(fp)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#") { // Comment
-			continue
-		}
-		deniedClients = append(deniedClients, line)
+	botConfig, err := LoadConfig(*configPath)
+	if err != nil {
+		logger.WithError(err).Fatal("Error while loading config")
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	if err := configureLogger(botConfig); err != nil {
+		logger.WithError(err).Fatal("Error while configuring logger")
 	}
-}
 
-func isDeniedClient(via string) bool {
-	for _, v := range deniedClients {
-		if v == via {
-			return true
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(botConfig, flag.Args()[1:]); err != nil {
+			logger.WithError(err).Fatal("Error while migrating")
 		}
+		return
 	}
-	return false
-}
 
-func main() {
-	var err error
 	err = sentry.Init(sentry.ClientOptions{
 		Dsn: botConfig.Sentry.Dsn,
 	})
 	if err != nil {
-		log.Fatal("sentry.Init: ", err)
+		logger.WithError(err).Fatal("Error while initializing sentry")
 	}
 
 	defer func() {
@@ -115,70 +81,118 @@ func main() {
 
 	gin.SetMode(gin.ReleaseMode)
 
-	db, err := sql.Open("mysql", botConfig.MySQL.User+":"+botConfig.MySQL.Password+"@"+botConfig.MySQL.Addr+"/"+botConfig.MySQL.DB+"?parseTime=true")
+	deps, err := Connect(botConfig)
 	if err != nil {
-		log.Fatal("Error while connecting to MySQL", err)
+		logger.WithError(err).WithFields(logrus.Fields{
+			"driver":       botConfig.Database.Driver,
+			"state_driver": botConfig.State.Driver,
+		}).Fatal("Error while connecting to dependencies")
 	}
-	dbMap = &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
-	dbMap.AddTableWithName(Download{}, "download")
-	defer func() {
-		_ = db.Close()
-	}()
 
-	redisClient = redis.NewClient(&redis.Options{
-		Network:  "unix",
-		DB:       botConfig.Redis.DB,
-		Addr:     botConfig.MySQL.Addr,
-		Password: botConfig.Redis.Password,
-	})
+	bot, err := NewBot(botConfig, deps)
+	if err != nil {
+		logger.WithError(err).Fatal("Error while fetching user")
+	}
+	defer bot.Close()
+	logger.WithField("screen_name", bot.ScreenName).Info("Logged in")
 
-	config := oauth1.NewConfig(botConfig.Twitter.ConsumerKey, botConfig.Twitter.ConsumerSecret)
-	token := oauth1.NewToken(botConfig.Twitter.AccessToken, botConfig.Twitter.AccessTokenSecret)
+	if err := bot.LoadDeniedClientList(deniedClientsPath); err != nil {
+		logger.WithError(err).Fatal("Error while loading denied clients")
+	}
 
-	client = twitter.NewClient(config.Client(oauth1.NoContext, token))
+	router := bot.NewRouter()
 
-	user, _, err := client.Accounts.VerifyCredentials(nil)
-	if err != nil {
-		log.Fatal("Error white fetching user", err)
+	// Start lookup queue and message queue processor
+	bot.Start()
+
+	// Now start serving!
+	configs := botConfig.listeners()
+	listeners := make([]net.Listener, 0, len(configs))
+	for _, config := range configs {
+		l, err := listen(config)
+		if err != nil {
+			logger.WithError(err).WithField("listener", config.String()).Fatal("Error while listening")
+		}
+		logger.WithField("listener", config.String()).Info("Listening")
+		listeners = append(listeners, l)
+	}
+
+	server := &http.Server{Handler: router}
+	serveErr := make(chan error, len(listeners))
+	serve(server, listeners, configs, serveErr)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Reload the config and the denied clients on SIGHUP or when the files are modified.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	stopWatching := make(chan struct{})
+	go newReloader(bot, *configPath, deniedClientsPath).watch(stopWatching, hangup)
+
+	select {
+	case sig := <-signals:
+		logger.WithField("signal", sig.String()).Info("Shutting down")
+	case err := <-serveErr:
+		err = fmt.Errorf("an error occurred while running gin: %s", err)
+		sentry.CaptureException(err)
+		logger.Error(err)
 	}
-	log.Println("Logged in to @" + user.ScreenName)
-	id = user.ID
-	user = nil
+	signal.Stop(signals)
+	signal.Stop(hangup)
+	close(stopWatching)
+
+	ctx, cancel := context.WithTimeout(context.Background(), botConfig.shutdownTimeout())
+	defer cancel()
 
+	// Stop accepting webhooks first, then drain the bot.
+	if err := server.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("Error while stopping server")
+	}
+	if err := bot.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("Could not finish commands and queues before the deadline")
+	}
+	logger.Info("Shut down")
+}
+
+// NewRouter はAPIとWebhookを処理するルーターを作成し、Webhookの受信を開始します。
+func (b *Bot) NewRouter() *gin.Engine {
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(requestLogger())
 
 	// CORS
 	router.Use(cors.New(cors.Config{
 		AllowMethods:     []string{"GET", "POST"},
 		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type"},
-		AllowOrigins:     []string{"https://bot.tomocraft.net"},
+		AllowOrigins:     b.Config().allowOrigins(),
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
 	}))
 
 	router.GET("/", func(context *gin.Context) {
-		context.String(200, user.ScreenName+" is online!")
+		context.String(200, b.ScreenName+" is online!")
 	})
-	router.GET("/api/downloads/:user", func(context *gin.Context) {
+	router.GET("/api/downloads/:user", b.requireDownloads([]Download{}), func(context *gin.Context) {
 		if user, ok := context.Params.Get("user"); ok {
+			// Look up by user ID so that downloads saved under an old screen name are included,
+			// and those of another user who used the name before are not.
+			userID, err := b.Downloads.UserID(user)
 			var downloads []Download
-			_, err := dbMap.Select(&downloads, "SELECT video_url,video_thumbnail,tweet_id FROM download WHERE screen_name = ?", user)
+			if err == nil {
+				if userID != 0 {
+					downloads, err = b.Downloads.ListByUser(userID, user)
+				} else {
+					downloads, err = b.Downloads.List(user)
+				}
+			}
 			if err != nil {
 				context.JSON(http.StatusInternalServerError, []Download{})
-				fmt.Printf("error on requesting to MySQL: %+v", err)
+				logger.WithError(err).Error("Error on requesting to database")
 				sentry.CaptureException(err)
 			} else {
-				n := len(downloads)
-				var res = make([]DownloadResponse, n)
-				for i := 0; i < n; i++ {
-					d := downloads[i]
-					res[i] = DownloadResponse{ // TODO
-						ScreenName:     d.ScreenName,
-						VideoURL:       d.VideoURL,
-						VideoThumbnail: d.VideoThumbnail,
-						TweetID:        strconv.FormatInt(d.TweetID, 10),
-					}
+				res := make([]DownloadResponse, len(downloads))
+				for i, d := range downloads {
+					res[i] = newDownloadResponse(d)
 				}
 				context.JSON(http.StatusOK, res)
 			}
@@ -186,15 +200,17 @@ func main() {
 			context.JSON(http.StatusBadRequest, []Download{})
 		}
 	})
-	router.GET("/api/suggests", func(context *gin.Context) {
+	router.GET("/api/suggests", b.requireDownloads([]string{}), func(context *gin.Context) {
 		if query, ok := context.GetQuery("query"); ok {
-			var screenNames []string
-			_, err := dbMap.Select(&screenNames, "SELECT DISTINCT screen_name FROM download WHERE screen_name LIKE ? LIMIT 10", "%"+escape(query)+"%")
+			screenNames, err := b.Downloads.SuggestScreenNames(query, 10)
 			if err != nil {
 				context.JSON(http.StatusInternalServerError, []string{})
-				fmt.Printf("Error on requesting to MySQL: %+v", err)
+				logger.WithError(err).Error("Error on requesting to database")
 				sentry.CaptureException(err)
 			} else {
+				if screenNames == nil {
+					screenNames = []string{}
+				}
 				context.JSON(http.StatusOK, screenNames)
 			}
 		} else {
@@ -202,49 +218,36 @@ func main() {
 		}
 	})
 
+	router.GET("/metrics", b.metricsHandler())
+	router.GET("/healthz", b.healthzHandler())
+	router.GET("/readyz", b.readyzHandler())
+
 	// Routing to GET /webhook for crc test!
-	router.GET(botConfig.Path.Webhook, twitter.CreateCRCHandler(botConfig.Twitter.ConsumerSecret))
+	router.GET(b.Config().Path.Webhook, twitter.CreateCRCHandler(b.Config().Twitter.ConsumerSecret))
 
 	// Routing to POST /webhook for handling webhook payload!
-	payloads := make(chan interface{})
-
-	handler, err := twitter.CreateWebhookHandler(payloads)
-	if err != nil {
-		sentry.CaptureException(err)
-		log.Fatal("Error while creating webhook handler", err)
-	}
-	// Make a debug handler to prints body of webhook.
-	debug := func(context *gin.Context) {
-		reader := &context.Request.Body
-		buf, _ := ioutil.ReadAll(*reader)
-		s := string(buf)
-		*reader = ioutil.NopCloser(bytes.NewBuffer(buf))
-		log.Printf("webhook debug:\n%s\n", s)
-	}
-	router.POST(botConfig.Path.Webhook, twitter.CreateTwitterAuthHandler(botConfig.Twitter.ConsumerSecret), debug, handler)
+	payloads := make(chan webhookEvent)
+	router.POST(b.Config().Path.Webhook, b.newWebhookHandler(payloads))
 
 	// Start listening payloads from webhook
-	go listen(payloads)
-
-	// Initialize queueProcessor
-	queueProcessor = NewLookupQueue()
-	go queueProcessor.StartTicker()
+	b.listenDone = make(chan struct{})
+	go b.listen(payloads)
 
-	// Start Message Queue Processor
-	go MessageSendTicker()
+	return router
+}
 
-	// Now start serving!
-	err = router.RunUnix("/var/run/twitter/bot.sock")
-	if err != nil {
-		err = fmt.Errorf("an error occurred while running gin: %s", err)
-		sentry.CaptureException(err)
-		log.Fatal(err)
+// requireDownloads はダウンロードの保存先が無い場合に、空の結果 empty と 503 を返すミドルウェアです。
+func (b *Bot) requireDownloads(empty interface{}) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if b.Downloads == nil {
+			context.AbortWithStatusJSON(http.StatusServiceUnavailable, empty)
+		}
 	}
 }
 
 // IsTimeRestricting は3:30から3:40の間だけtrueを返し、それ以外の時間の場合はfalseを返します
-func IsTimeRestricting() bool {
-	now := time.Now()
+func (b *Bot) IsTimeRestricting() bool {
+	now := b.now().In(location)
 	return now.Hour() == 3 && now.Minute() >= 30 && now.Minute() <= 40 // 3:30 ~ 3:40
 }
 
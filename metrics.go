@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "tomobotter"
+
+var (
+	webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_events_total",
+		Help:      "Number of webhook events received, by event type.",
+	}, []string{"type"})
+
+	commandsDispatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_dispatched_total",
+		Help:      "Number of commands dispatched, by command and sender type.",
+	}, []string{"command", "sender"})
+
+	lookupQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookup_queue_depth",
+		Help:      "Number of tweet ids waiting to be looked up.",
+	})
+
+	lookupBatchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookup_batch_size",
+		Help:      "Number of tweet ids looked up at once, by endpoint.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+	}, []string{"endpoint"})
+
+	lookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookup_duration_seconds",
+		Help:      "Time from enqueueing a tweet id until its result is delivered, by result.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"result"})
+
+	tweetCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tweet_cache_requests_total",
+		Help:      "Number of tweet cache lookups, by result (memory_hit, redis_hit or miss).",
+	}, []string{"result"})
+
+	tweetsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tweets_sent_total",
+		Help:      "Number of tweets sent, by message priority.",
+	}, []string{"priority"})
+
+	tweetsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tweets_failed_total",
+		Help:      "Number of failed status updates, by Twitter error code.",
+	}, []string{"code"})
+
+	directMessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "direct_messages_failed_total",
+		Help:      "Number of failed direct messages, by Twitter error code.",
+	}, []string{"code"})
+)
+
+// errorCodeLabel はメトリクスのラベルにするTwitterのエラーコードを返します。
+// Twitterのエラーでない場合は "none" を返します。
+func errorCodeLabel(err error) string {
+	if code := apiErrorCode(err); code != 0 {
+		return strconv.Itoa(code)
+	}
+	return "none"
+}
+
+// lookupResultLabel はメトリクスのラベルにする検索の結果を返します。
+func lookupResultLabel(err error) string {
+	switch err {
+	case nil:
+		return "found"
+	case ErrTweetNotFound:
+		return "not_found"
+	case ErrTweetProtected:
+		return "protected"
+	}
+	return "error"
+}
+
+func (t SenderType) String() string {
+	switch t {
+	case SenderTimeline:
+		return "timeline"
+	case SenderDirectMessage:
+		return "direct_message"
+	}
+	return "unknown"
+}
+
+var (
+	replyBlockedDesc = prometheus.NewDesc(metricsNamespace+"_reply_blocked",
+		"Whether tweeting is blocked by the rate limit (1) or not (0).", nil, nil)
+	replyBlockedUntilDesc = prometheus.NewDesc(metricsNamespace+"_reply_blocked_until_seconds",
+		"Unix time when the tweet block is lifted, 0 if not blocked.", nil, nil)
+	tweetBudgetLimitDesc = prometheus.NewDesc(metricsNamespace+"_tweet_budget_limit",
+		"Number of tweets allowed in 24 hours.", nil, nil)
+	tweetBudgetUsedDesc = prometheus.NewDesc(metricsNamespace+"_tweet_budget_used",
+		"Number of tweets sent in the last 24 hours.", nil, nil)
+	apiRateLimitRemainingDesc = prometheus.NewDesc(metricsNamespace+"_api_rate_limit_remaining",
+		"Remaining calls of the Twitter API endpoint reported by x-rate-limit-remaining.", []string{"endpoint"}, nil)
+	apiRateLimitResetDesc = prometheus.NewDesc(metricsNamespace+"_api_rate_limit_reset_seconds",
+		"Unix time when the rate limit of the Twitter API endpoint is reset.", []string{"endpoint"}, nil)
+	outboundQueueLengthDesc = prometheus.NewDesc(metricsNamespace+"_outbound_queue_length",
+		"Number of messages waiting to be tweeted.", nil, nil)
+	profileStateDesc = prometheus.NewDesc(metricsNamespace+"_profile_state",
+		"Current profile state (0: normal, 1: restricted, 2: rate limited, 3: maintenance).", nil, nil)
+)
+
+// stateCollector はRedisなどに記録されている現在の制限の状態を、収集されるたびに読み込みます。
+type stateCollector struct {
+	bot *Bot
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replyBlockedDesc
+	ch <- replyBlockedUntilDesc
+	ch <- tweetBudgetLimitDesc
+	ch <- tweetBudgetUsedDesc
+	ch <- apiRateLimitRemainingDesc
+	ch <- apiRateLimitResetDesc
+	ch <- outboundQueueLengthDesc
+	ch <- profileStateDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	b := c.bot
+
+	until := b.noReplyUntil()
+	blocked, untilSeconds := 0.0, 0.0
+	if !until.IsZero() {
+		blocked, untilSeconds = 1, float64(until.Unix())
+	}
+	ch <- prometheus.MustNewConstMetric(replyBlockedDesc, prometheus.GaugeValue, blocked)
+	ch <- prometheus.MustNewConstMetric(replyBlockedUntilDesc, prometheus.GaugeValue, untilSeconds)
+
+	if budget, err := b.TweetBudget(); err == nil {
+		ch <- prometheus.MustNewConstMetric(tweetBudgetLimitDesc, prometheus.GaugeValue, float64(budget.Limit))
+		ch <- prometheus.MustNewConstMetric(tweetBudgetUsedDesc, prometheus.GaugeValue, float64(budget.Used))
+	} else {
+		sentry.CaptureException(fmt.Errorf("error occurred while collecting tweet budget: %s", err))
+	}
+
+	now := b.now()
+	for _, endpoint := range []string{EndpointStatusesLookup, EndpointStatusesShow} {
+		budget, err := b.lookupQueue.budgets.Get(endpoint, now)
+		if err != nil {
+			sentry.CaptureException(fmt.Errorf("error occurred while collecting api rate limit: %s", err))
+			continue
+		}
+		if !budget.Known() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(apiRateLimitRemainingDesc, prometheus.GaugeValue, float64(budget.Remaining), endpoint)
+		ch <- prometheus.MustNewConstMetric(apiRateLimitResetDesc, prometheus.GaugeValue, float64(budget.Reset.Unix()), endpoint)
+	}
+
+	if n, err := b.outbound.Len(); err == nil {
+		ch <- prometheus.MustNewConstMetric(outboundQueueLengthDesc, prometheus.GaugeValue, float64(n))
+	} else {
+		sentry.CaptureException(fmt.Errorf("error occurred while collecting outbound queue length: %s", err))
+	}
+
+	ch <- prometheus.MustNewConstMetric(profileStateDesc, prometheus.GaugeValue, float64(b.profile.current()))
+}
+
+// metricsHandler は /metrics のハンドラーです。
+// プロセス全体のメトリクスに加えて、このBotの制限の状態を返します。
+func (b *Bot) metricsHandler() gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(stateCollector{bot: b})
+
+	handler := promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{})
+	return gin.WrapH(handler)
+}
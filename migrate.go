@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// migrationsTable は適用したマイグレーションを記録するテーブルです。
+const migrationsTable = "schema_migrations"
+
+// migration はデータベースのスキーマの変更です。Version の順に適用されます。
+// MySQLは複数の文を一度に実行できないため、Up と Down は文ごとに分けて書きます。
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+	// SQLiteUp と SQLiteDown はSQLiteで Up と Down の代わりに実行します。空の場合は Up と Down を実行します。
+	SQLiteUp   []string
+	SQLiteDown []string
+}
+
+func (m migration) up(driver string) []string {
+	if driver == DriverSQLite && len(m.SQLiteUp) > 0 {
+		return m.SQLiteUp
+	}
+	return m.Up
+}
+
+func (m migration) down(driver string) []string {
+	if driver == DriverSQLite && len(m.SQLiteDown) > 0 {
+		return m.SQLiteDown
+	}
+	return m.Down
+}
+
+// migrations はすべてのマイグレーションです。適用済みのものは変更せず、末尾に追加してください。
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create_download",
+		Up: []string{`CREATE TABLE IF NOT EXISTS download (
+	screen_name VARCHAR(15) NOT NULL,
+	tweet_id BIGINT NOT NULL,
+	video_url VARCHAR(1024) NOT NULL,
+	video_thumbnail VARCHAR(1024) NOT NULL,
+	PRIMARY KEY (screen_name, tweet_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`},
+		Down: []string{`DROP TABLE download`},
+		SQLiteUp: []string{`CREATE TABLE IF NOT EXISTS download (
+	screen_name VARCHAR(15) NOT NULL,
+	tweet_id BIGINT NOT NULL,
+	video_url VARCHAR(1024) NOT NULL,
+	video_thumbnail VARCHAR(1024) NOT NULL,
+	PRIMARY KEY (screen_name, tweet_id)
+)`},
+	},
+	{
+		Version: 2,
+		Name:    "add_download_metadata",
+		Up: []string{
+			`ALTER TABLE download ADD COLUMN user_id BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE download ADD COLUMN author_id BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE download ADD COLUMN author_screen_name VARCHAR(15) NOT NULL DEFAULT ''`,
+			`ALTER TABLE download ADD COLUMN tweet_text VARCHAR(1024) NOT NULL DEFAULT ''`,
+			`ALTER TABLE download ADD COLUMN media_type VARCHAR(16) NOT NULL DEFAULT ''`,
+			`ALTER TABLE download ADD COLUMN duration_ms INT NOT NULL DEFAULT 0`,
+			`ALTER TABLE download ADD COLUMN bitrate INT NOT NULL DEFAULT 0`,
+			`ALTER TABLE download ADD COLUMN variants TEXT NULL`,
+			`ALTER TABLE download ADD COLUMN requested_at DATETIME NULL`,
+			`CREATE INDEX download_user_id ON download (user_id)`,
+		},
+		Down: []string{`ALTER TABLE download
+	DROP INDEX download_user_id,
+	DROP COLUMN user_id,
+	DROP COLUMN author_id,
+	DROP COLUMN author_screen_name,
+	DROP COLUMN tweet_text,
+	DROP COLUMN media_type,
+	DROP COLUMN duration_ms,
+	DROP COLUMN bitrate,
+	DROP COLUMN variants,
+	DROP COLUMN requested_at`},
+		// SQLite before 3.35 cannot drop columns, so the table is rebuilt with the version 1 schema.
+		SQLiteDown: []string{
+			`DROP INDEX download_user_id`,
+			`CREATE TABLE download_v1 (
+	screen_name VARCHAR(15) NOT NULL,
+	tweet_id BIGINT NOT NULL,
+	video_url VARCHAR(1024) NOT NULL,
+	video_thumbnail VARCHAR(1024) NOT NULL,
+	PRIMARY KEY (screen_name, tweet_id)
+)`,
+			`INSERT INTO download_v1 (screen_name, tweet_id, video_url, video_thumbnail) SELECT screen_name, tweet_id, video_url, video_thumbnail FROM download`,
+			`DROP TABLE download`,
+			`ALTER TABLE download_v1 RENAME TO download`,
+		},
+	},
+	{
+		// A user who has changed their screen name could save the same tweet under both names.
+		// Such duplicates are removed, keeping the most recently requested one; Down does not restore them.
+		Version: 3,
+		Name:    "add_download_user_tweet_unique",
+		// MySQL has no partial indexes, so the unique key is on a column that is NULL instead of 0.
+		Up: []string{
+			`DELETE d FROM download d JOIN download newer
+	ON newer.user_id = d.user_id AND newer.tweet_id = d.tweet_id AND newer.screen_name <> d.screen_name
+	WHERE d.user_id <> 0 AND (COALESCE(newer.requested_at, '1970-01-01') > COALESCE(d.requested_at, '1970-01-01')
+		OR (COALESCE(newer.requested_at, '1970-01-01') = COALESCE(d.requested_at, '1970-01-01') AND newer.screen_name > d.screen_name))`,
+			`ALTER TABLE download ADD COLUMN unique_user_id BIGINT AS (NULLIF(user_id, 0)) STORED`,
+			`CREATE UNIQUE INDEX download_user_tweet ON download (unique_user_id, tweet_id)`,
+		},
+		Down: []string{`ALTER TABLE download
+	DROP INDEX download_user_tweet,
+	DROP COLUMN unique_user_id`},
+		SQLiteUp: []string{
+			`DELETE FROM download WHERE user_id <> 0 AND EXISTS (SELECT 1 FROM download newer
+	WHERE newer.user_id = download.user_id AND newer.tweet_id = download.tweet_id AND newer.screen_name <> download.screen_name
+		AND (COALESCE(newer.requested_at, '') > COALESCE(download.requested_at, '')
+			OR (COALESCE(newer.requested_at, '') = COALESCE(download.requested_at, '') AND newer.screen_name > download.screen_name)))`,
+			`CREATE UNIQUE INDEX download_user_tweet ON download (user_id, tweet_id) WHERE user_id <> 0`,
+		},
+		SQLiteDown: []string{`DROP INDEX download_user_tweet`},
+	},
+}
+
+// MigrationState はマイグレーションと、それが適用された時間です。
+type MigrationState struct {
+	Version int
+	Name    string
+	// AppliedAt は適用されていない場合はゼロです。
+	AppliedAt time.Time
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+	version INT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at DATETIME NOT NULL
+)`)
+	return err
+}
+
+// MigrationStatus はすべてのマイグレーションが適用されているかを返します。
+func MigrationStatus(db *sql.DB) ([]MigrationState, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, applied_at FROM ` + migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]}
+	}
+	return states, nil
+}
+
+// MigrateUp は適用されていないマイグレーションをすべて適用し、適用したものを返します。
+// driver は DriverMySQL か DriverSQLite です。
+func MigrateUp(db *sql.DB, driver string) ([]MigrationState, error) {
+	states, err := MigrationStatus(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []MigrationState
+	for i, state := range states {
+		if !state.AppliedAt.IsZero() {
+			continue
+		}
+		m := migrations[i]
+		state.AppliedAt = time.Now().UTC().Truncate(time.Second)
+		err := execMigration(db, driver, m.up(driver), func(exec sqlExecer) error {
+			_, err := exec.Exec(`INSERT INTO `+migrationsTable+` (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, state.AppliedAt)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %s", m.Version, m.Name, err)
+		}
+		done = append(done, state)
+	}
+	return done, nil
+}
+
+// MigrateDown は適用されているマイグレーションを新しいものから steps 個戻し、戻したものを返します。
+func MigrateDown(db *sql.DB, driver string, steps int) ([]MigrationState, error) {
+	states, err := MigrationStatus(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []MigrationState
+	for i := len(states) - 1; i >= 0 && len(done) < steps; i-- {
+		if states[i].AppliedAt.IsZero() {
+			continue
+		}
+		m := migrations[i]
+		err := execMigration(db, driver, m.down(driver), func(exec sqlExecer) error {
+			_, err := exec.Exec(`DELETE FROM `+migrationsTable+` WHERE version = ?`, m.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %s", m.Version, m.Name, err)
+		}
+		done = append(done, states[i])
+	}
+	return done, nil
+}
+
+// sqlExecer は *sql.DB と *sql.Tx のどちらでも文を実行できるようにします。
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// execMigration は一つのマイグレーションの文を実行し、record で migrationsTable を更新します。
+// SQLiteではすべてを一つのトランザクションで実行するため、途中で失敗しても何も変更されません。
+// MySQLではDDLが暗黙的にコミットされてトランザクションにできないため、途中で失敗するとそれまでの文は適用されたまま残ります。
+// その場合は migrationsTable に記録されないので、残った変更を手動で戻してから実行し直してください。
+func execMigration(db *sql.DB, driver string, statements []string, record func(sqlExecer) error) error {
+	if driver != DriverSQLite {
+		for _, statement := range statements {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return record(db)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrate は migrate サブコマンドです。
+// up は適用されていないものをすべて適用し、down は最後に適用したものを引数の数（省略した場合は1つ）だけ戻し、
+// status は適用されているかの一覧を表示します。
+func runMigrate(config Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	db, driver, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := MigrateUp(db, driver)
+		for _, state := range done {
+			logger.WithField("version", state.Version).WithField("name", state.Name).Info("Applied migration")
+		}
+		if err == nil && len(done) == 0 {
+			logger.Info("No migrations to apply")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid steps %q", args[1])
+			}
+		}
+		done, err := MigrateDown(db, driver, steps)
+		for _, state := range done {
+			logger.WithField("version", state.Version).WithField("name", state.Name).Info("Reverted migration")
+		}
+		return err
+	case "status":
+		states, err := MigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, state := range states {
+			appliedAt := "pending"
+			if !state.AppliedAt.IsZero() {
+				appliedAt = state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", state.Version, state.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q: usage: migrate up|down [steps]|status", args[0])
+	}
+}
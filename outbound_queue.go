@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Redis Key, outbound:pending:<lane>
+	OutboundPendingPrefix = "outbound:pending:"
+	OutboundProcessing    = "outbound:processing"
+	OutboundDead          = "outbound:dead"
+
+	// maxDeadMessages はデッドレターとして残しておくメッセージの最大数です。
+	maxDeadMessages = 1000
+)
+
+// Priority は送信の優先度です。値が大きいほど先に送信されます。
+type Priority int
+
+const (
+	// PriorityNotice は送信できなくても問題ない通知です。ツイートの制限中は破棄されます。
+	PriorityNotice Priority = iota
+	// PriorityBroadcast はリプライではないお知らせです。
+	PriorityBroadcast
+	// PriorityReply はコマンドへの返信です。
+	PriorityReply
+)
+
+// outboundLanes は優先度の高い順に並べた優先度です。
+var outboundLanes = []Priority{PriorityReply, PriorityBroadcast, PriorityNotice}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityReply:
+		return "reply"
+	case PriorityBroadcast:
+		return "broadcast"
+	default:
+		return "notice"
+	}
+}
+
+func pendingKey(p Priority) string {
+	return OutboundPendingPrefix + p.String()
+}
+
+// Message は送信待ちのツイートです。
+type Message struct {
+	ID       string   `json:"id"`
+	Text     string   `json:"text"`
+	ReplyID  int64    `json:"reply_id,omitempty"`
+	Priority Priority `json:"priority"`
+
+	// RecipientID と Body はリプライの宛先のユーザーと、メンションを除いた本文です。
+	// ツイートの残りが少ない場合に、ダイレクトメッセージで代わりに送信するために使います。
+	RecipientID int64  `json:"recipient_id,omitempty"`
+	Body        string `json:"body,omitempty"`
+
+	// CorrelationID はこのメッセージを送信するきっかけになったイベントのIDです。
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Attempts は送信に失敗した回数です。
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+
+	// raw はキューに保存されている形式です。キューから削除するときに使います。
+	raw string
+}
+
+func newMessage(text string, replyID int64, priority Priority) Message {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return Message{
+		ID:       strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + hex.EncodeToString(buf),
+		Text:     text,
+		ReplyID:  replyID,
+		Priority: priority,
+	}
+}
+
+// OutboundQueue は送信待ちのツイートを保持するキューです。
+// 取り出したメッセージは Ack, Retry, DeadLetter のいずれかで処理を終えるまで処理中として扱われます。
+type OutboundQueue interface {
+	// Enqueue はメッセージを at 以降に送信するように追加します。
+	Enqueue(m Message, at time.Time) error
+	// Next は now までに送信するべきメッセージのうち、最も優先度の高いものを一つ取り出します。
+	// 無い場合はfalseを返します。
+	Next(now time.Time) (Message, bool, error)
+	// Ack は送信に成功したメッセージをキューから削除します。
+	Ack(m Message) error
+	// Retry は処理中のメッセージを at 以降に再び送信するように戻します。
+	Retry(m Message, at time.Time) error
+	// DeadLetter は送信できなかったメッセージをデッドレターに移します。
+	DeadLetter(m Message) error
+	// Shed は優先度が p 以下の送信待ちのメッセージを、保存されている形式のままデッドレターに移します。
+	Shed(p Priority) (int, error)
+	// Recover は前回の終了時に処理中だったメッセージを送信待ちに戻します。
+	Recover(now time.Time) (int, error)
+	// Len は送信待ちと処理中のメッセージの数を返します。
+	Len() (int, error)
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// redisOutboundQueue は優先度ごとにRedisのソート済みセットを持ち、送信予定時刻をスコアとして保存します。
+// Botを再起動しても送信待ちのメッセージは失われません。
+type redisOutboundQueue struct {
+	redis *redis.Client
+}
+
+func NewRedisOutboundQueue(redisClient *redis.Client) OutboundQueue {
+	return &redisOutboundQueue{redis: redisClient}
+}
+
+// popDueScript は送信予定時刻を過ぎたメッセージを優先度の高いキーから順に探し、一つを処理中に移して返します。
+// KEYS の最後は処理中のメッセージのキーです。
+var popDueScript = redis.NewScript(`
+local processing = KEYS[#KEYS]
+for i = 1, #KEYS - 1 do
+	local items = redis.call('ZRANGEBYSCORE', KEYS[i], '-inf', ARGV[1], 'LIMIT', 0, 1)
+	if #items > 0 then
+		redis.call('ZREM', KEYS[i], items[1])
+		redis.call('ZADD', processing, ARGV[1], items[1])
+		return items[1]
+	end
+end
+return false
+`)
+
+// recoverScript は処理中のメッセージをすべて、優先度に応じた送信待ちのキーに戻します。
+var recoverScript = redis.NewScript(`
+local items = redis.call('ZRANGE', KEYS[1], 0, -1)
+for _, item in ipairs(items) do
+	local priority = cjson.decode(item).priority or 0
+	redis.call('ZADD', ARGV[2] .. ARGV[3 + priority], ARGV[1], item)
+end
+redis.call('DEL', KEYS[1])
+return #items
+`)
+
+// shedScript は KEYS[2] 以降の送信待ちのメッセージをすべてデッドレター KEYS[1] に移します。
+// cjson はIDなどの大きな整数を浮動小数点数にしてしまうため、メッセージはデコードせずにそのまま移します。
+var shedScript = redis.NewScript(`
+local count = 0
+for i = 2, #KEYS do
+	local items = redis.call('ZRANGE', KEYS[i], 0, -1)
+	for _, item in ipairs(items) do
+		redis.call('LPUSH', KEYS[1], item)
+	end
+	redis.call('DEL', KEYS[i])
+	count = count + #items
+end
+redis.call('LTRIM', KEYS[1], 0, ARGV[1] - 1)
+return count
+`)
+
+func (q *redisOutboundQueue) Enqueue(m Message, at time.Time) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return q.redis.ZAdd(pendingKey(m.Priority), redis.Z{Score: float64(unixMillis(at)), Member: string(raw)}).Err()
+}
+
+func (q *redisOutboundQueue) Next(now time.Time) (Message, bool, error) {
+	keys := make([]string, 0, len(outboundLanes)+1)
+	for _, p := range outboundLanes {
+		keys = append(keys, pendingKey(p))
+	}
+	keys = append(keys, OutboundProcessing)
+
+	raw, err := popDueScript.Run(q.redis, keys, unixMillis(now)).String()
+	if err == redis.Nil {
+		return Message{}, false, nil
+	} else if err != nil {
+		return Message{}, false, err
+	}
+
+	var m Message
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		// Broken message can never be sent, so move it to dead letter as is.
+		q.redis.ZRem(OutboundProcessing, raw)
+		q.redis.LPush(OutboundDead, raw)
+		return Message{}, false, err
+	}
+	m.raw = raw
+	return m, true, nil
+}
+
+func (q *redisOutboundQueue) Ack(m Message) error {
+	return q.redis.ZRem(OutboundProcessing, m.raw).Err()
+}
+
+func (q *redisOutboundQueue) Retry(m Message, at time.Time) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = q.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(OutboundProcessing, m.raw)
+		pipe.ZAdd(pendingKey(m.Priority), redis.Z{Score: float64(unixMillis(at)), Member: string(raw)})
+		return nil
+	})
+	return err
+}
+
+func (q *redisOutboundQueue) DeadLetter(m Message) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = q.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(OutboundProcessing, m.raw)
+		pipe.LPush(OutboundDead, string(raw))
+		pipe.LTrim(OutboundDead, 0, maxDeadMessages-1)
+		return nil
+	})
+	return err
+}
+
+func (q *redisOutboundQueue) Shed(p Priority) (int, error) {
+	keys := []string{OutboundDead}
+	for _, lane := range outboundLanes {
+		if lane <= p {
+			keys = append(keys, pendingKey(lane))
+		}
+	}
+	n, err := shedScript.Run(q.redis, keys, maxDeadMessages).Int64()
+	return int(n), err
+}
+
+func (q *redisOutboundQueue) Recover(now time.Time) (int, error) {
+	// ARGV[3 + priority] is the lane name of the priority.
+	args := []interface{}{unixMillis(now), OutboundPendingPrefix}
+	for p := PriorityNotice; p <= PriorityReply; p++ {
+		args = append(args, p.String())
+	}
+	n, err := recoverScript.Run(q.redis, []string{OutboundProcessing}, args...).Int64()
+	return int(n), err
+}
+
+func (q *redisOutboundQueue) Len() (int, error) {
+	cmds := make([]*redis.IntCmd, 0, len(outboundLanes)+1)
+	_, err := q.redis.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, p := range outboundLanes {
+			cmds = append(cmds, pipe.ZCard(pendingKey(p)))
+		}
+		cmds = append(cmds, pipe.ZCard(OutboundProcessing))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, cmd := range cmds {
+		n += int(cmd.Val())
+	}
+	return n, nil
+}
+
+// memoryOutboundQueue はメモリ上で動作する OutboundQueue です。
+// Redisを使わずにBotを動かす場合に利用します。再起動するとメッセージは失われます。
+type memoryOutboundQueue struct {
+	mu         sync.Mutex
+	pending    []scheduledMessage
+	processing map[string]Message
+	dead       []Message
+}
+
+type scheduledMessage struct {
+	at      time.Time
+	message Message
+}
+
+func NewMemoryOutboundQueue() OutboundQueue {
+	return &memoryOutboundQueue{
+		processing: make(map[string]Message),
+	}
+}
+
+func (q *memoryOutboundQueue) Enqueue(m Message, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.schedule(m, at)
+	return nil
+}
+
+func (q *memoryOutboundQueue) schedule(m Message, at time.Time) {
+	i := sort.Search(len(q.pending), func(i int) bool {
+		return q.pending[i].at.After(at)
+	})
+	q.pending = append(q.pending, scheduledMessage{})
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = scheduledMessage{at: at, message: m}
+}
+
+func (q *memoryOutboundQueue) Next(now time.Time) (Message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	found := -1
+	for i, s := range q.pending {
+		if s.at.After(now) {
+			break // pending is sorted by time.
+		}
+		if found == -1 || s.message.Priority > q.pending[found].message.Priority {
+			found = i
+		}
+	}
+	if found == -1 {
+		return Message{}, false, nil
+	}
+
+	m := q.pending[found].message
+	q.pending = append(q.pending[:found], q.pending[found+1:]...)
+	q.processing[m.ID] = m
+	return m, true, nil
+}
+
+func (q *memoryOutboundQueue) Ack(m Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, m.ID)
+	return nil
+}
+
+func (q *memoryOutboundQueue) Retry(m Message, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, m.ID)
+	q.schedule(m, at)
+	return nil
+}
+
+func (q *memoryOutboundQueue) DeadLetter(m Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, m.ID)
+	q.dead = append(q.dead, m)
+	if len(q.dead) > maxDeadMessages {
+		q.dead = q.dead[len(q.dead)-maxDeadMessages:]
+	}
+	return nil
+}
+
+func (q *memoryOutboundQueue) Shed(p Priority) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	pending := q.pending[:0]
+	for _, s := range q.pending {
+		if s.message.Priority <= p {
+			q.dead = append(q.dead, s.message)
+			n++
+		} else {
+			pending = append(pending, s)
+		}
+	}
+	q.pending = pending
+	if len(q.dead) > maxDeadMessages {
+		q.dead = q.dead[len(q.dead)-maxDeadMessages:]
+	}
+	return n, nil
+}
+
+func (q *memoryOutboundQueue) Recover(now time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.processing)
+	for id, m := range q.processing {
+		delete(q.processing, id)
+		q.schedule(m, now)
+	}
+	return n, nil
+}
+
+func (q *memoryOutboundQueue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) + len(q.processing), nil
+}
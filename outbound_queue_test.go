@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// outboundQueueDriver はキューと、デッドレターにあるメッセージの本文を読み出す関数です。
+type outboundQueueDriver struct {
+	name string
+	new  func(t *testing.T) (OutboundQueue, func() []string)
+}
+
+var outboundQueueDrivers = []outboundQueueDriver{
+	{"memory", func(*testing.T) (OutboundQueue, func() []string) {
+		q := NewMemoryOutboundQueue().(*memoryOutboundQueue)
+		return q, func() []string {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			var texts []string
+			for _, m := range q.dead {
+				texts = append(texts, m.Text)
+			}
+			sort.Strings(texts)
+			return texts
+		}
+	}},
+	{"redis", func(t *testing.T) (OutboundQueue, func() []string) {
+		client := newTestRedis(t)
+		return NewRedisOutboundQueue(client), func() []string {
+			items, err := client.LRange(OutboundDead, 0, -1).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var texts []string
+			for _, raw := range items {
+				var m Message
+				if err := json.Unmarshal([]byte(raw), &m); err != nil {
+					t.Fatal(err)
+				}
+				texts = append(texts, m.Text)
+			}
+			sort.Strings(texts)
+			return texts
+		}
+	}},
+}
+
+func runOutboundQueueTest(t *testing.T, test func(t *testing.T, q OutboundQueue, dead func() []string)) {
+	for _, driver := range outboundQueueDrivers {
+		t.Run(driver.name, func(t *testing.T) {
+			q, dead := driver.new(t)
+			test(t, q, dead)
+		})
+	}
+}
+
+func enqueueMessages(t *testing.T, q OutboundQueue, at time.Time, messages ...Message) {
+	t.Helper()
+	for _, m := range messages {
+		if err := q.Enqueue(m, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// drainTexts は now までに送信するべきメッセージをすべて取り出し、その順番に本文を返します。
+func drainTexts(t *testing.T, q OutboundQueue, now time.Time) []string {
+	t.Helper()
+	var texts []string
+	for {
+		m, ok, err := q.Next(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return texts
+		}
+		texts = append(texts, m.Text)
+		if err := q.Ack(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertQueueLen(t *testing.T, q OutboundQueue, want int) {
+	t.Helper()
+	if n, err := q.Len(); err != nil || n != want {
+		t.Errorf("Len = %d, %v, want %d", n, err, want)
+	}
+}
+
+func TestOutboundQueueOrder(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, _ func() []string) {
+		clock := newTestClock()
+		now := clock.now()
+		enqueueMessages(t, q, now.Add(-time.Minute), newMessage("notice", 0, PriorityNotice))
+		enqueueMessages(t, q, now,
+			newMessage("broadcast", 0, PriorityBroadcast),
+			newMessage("reply", 1, PriorityReply),
+		)
+		// 優先度が高くても、送信予定時刻の前には取り出しません。
+		enqueueMessages(t, q, now.Add(time.Minute), newMessage("later reply", 2, PriorityReply))
+		assertQueueLen(t, q, 4)
+
+		if got, want := drainTexts(t, q, now), []string{"reply", "broadcast", "notice"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Next order = %q, want %q", got, want)
+		}
+		assertQueueLen(t, q, 1)
+
+		clock.advance(time.Minute)
+		if got, want := drainTexts(t, q, clock.now()), []string{"later reply"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Next after the scheduled time = %q, want %q", got, want)
+		}
+		assertQueueLen(t, q, 0)
+	})
+}
+
+func TestOutboundQueueRetry(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, _ func() []string) {
+		clock := newTestClock()
+		enqueueMessages(t, q, clock.now(), newMessage("reply", 1, PriorityReply))
+
+		m, ok, err := q.Next(clock.now())
+		if err != nil || !ok {
+			t.Fatalf("Next = %v, %v, want a message", ok, err)
+		}
+		// 処理中のメッセージも数えます。
+		assertQueueLen(t, q, 1)
+
+		m.Attempts++
+		m.LastError = "temporary"
+		if err := q.Retry(m, clock.now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		assertQueueLen(t, q, 1)
+		if _, ok, _ := q.Next(clock.now()); ok {
+			t.Error("Next returned the message before the retry time")
+		}
+
+		clock.advance(time.Minute)
+		retried, ok, err := q.Next(clock.now())
+		if err != nil || !ok {
+			t.Fatalf("Next after the retry time = %v, %v, want a message", ok, err)
+		}
+		if retried.ID != m.ID || retried.Attempts != 1 || retried.LastError != "temporary" {
+			t.Errorf("retried message = %+v, want %+v", retried, m)
+		}
+	})
+}
+
+func TestOutboundQueueDeadLetter(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, dead func() []string) {
+		clock := newTestClock()
+		enqueueMessages(t, q, clock.now(),
+			newMessage("a", 1, PriorityReply),
+			newMessage("b", 2, PriorityReply),
+		)
+		for i := 0; i < 2; i++ {
+			m, ok, err := q.Next(clock.now())
+			if err != nil || !ok {
+				t.Fatalf("Next = %v, %v, want a message", ok, err)
+			}
+			if err := q.DeadLetter(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertQueueLen(t, q, 0)
+		if got, want := dead(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("dead letters = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestOutboundQueueDeadLetterTrim(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, dead func() []string) {
+		clock := newTestClock()
+		for i := 0; i < maxDeadMessages+10; i++ {
+			enqueueMessages(t, q, clock.now(), newMessage("notice", 0, PriorityNotice))
+		}
+		if n, err := q.Shed(PriorityNotice); err != nil || n != maxDeadMessages+10 {
+			t.Errorf("Shed = %d, %v, want %d", n, err, maxDeadMessages+10)
+		}
+		if n := len(dead()); n != maxDeadMessages {
+			t.Errorf("dead letters = %d, want %d", n, maxDeadMessages)
+		}
+	})
+}
+
+func TestOutboundQueueShed(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, dead func() []string) {
+		clock := newTestClock()
+		enqueueMessages(t, q, clock.now(),
+			newMessage("notice", 0, PriorityNotice),
+			newMessage("broadcast", 0, PriorityBroadcast),
+			newMessage("reply", 1, PriorityReply),
+		)
+		// 処理中のメッセージは移しません。
+		enqueueMessages(t, q, clock.now().Add(-time.Minute), newMessage("sending notice", 0, PriorityNotice))
+		sending, ok, err := q.Next(clock.now())
+		if err != nil || !ok || sending.Text != "reply" {
+			t.Fatalf("Next = %+v, %v, %v, want the reply", sending, ok, err)
+		}
+
+		if n, err := q.Shed(PriorityNotice); err != nil || n != 2 {
+			t.Errorf("Shed(notice) = %d, %v, want 2", n, err)
+		}
+		if got, want := dead(), []string{"notice", "sending notice"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("dead letters = %q, want %q", got, want)
+		}
+		assertQueueLen(t, q, 2)
+
+		if n, err := q.Shed(PriorityBroadcast); err != nil || n != 1 {
+			t.Errorf("Shed(broadcast) = %d, %v, want 1", n, err)
+		}
+		assertQueueLen(t, q, 1)
+		if err := q.Ack(sending); err != nil {
+			t.Fatal(err)
+		}
+		assertQueueLen(t, q, 0)
+	})
+}
+
+func TestOutboundQueueRecover(t *testing.T) {
+	runOutboundQueueTest(t, func(t *testing.T, q OutboundQueue, _ func() []string) {
+		clock := newTestClock()
+		enqueueMessages(t, q, clock.now(),
+			newMessage("broadcast", 0, PriorityBroadcast),
+			newMessage("reply", 1, PriorityReply),
+		)
+		for i := 0; i < 2; i++ {
+			if _, ok, err := q.Next(clock.now()); err != nil || !ok {
+				t.Fatalf("Next = %v, %v, want a message", ok, err)
+			}
+		}
+		if _, ok, _ := q.Next(clock.now()); ok {
+			t.Fatal("Next returned a message that is being processed")
+		}
+
+		clock.advance(time.Minute)
+		if n, err := q.Recover(clock.now()); err != nil || n != 2 {
+			t.Errorf("Recover = %d, %v, want 2", n, err)
+		}
+		// 戻したメッセージも優先度の順に取り出します。
+		if got, want := drainTexts(t, q, clock.now()), []string{"reply", "broadcast"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Next order after Recover = %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+const (
+	// Redis Key
+	OriginalProfile = "original-profile"
+
+	// profileRetryMax は失敗したプロフィールの更新を再び試みるまでの最大の時間です。
+	profileRetryMax = 10 * time.Minute
+	// profileCheckInterval は時間によって変わる状態を確かめる間隔です。
+	profileCheckInterval = 30 * time.Second
+)
+
+// ProfileState はプロフィールに表示するBotの状態です。
+// 複数の状態が同時に有効な場合は、値の大きいものが表示されます。
+type ProfileState int
+
+const (
+	ProfileNormal ProfileState = iota
+	// ProfileRestricted は3:30から3:40の間、ダウンロードを制限している状態です。
+	ProfileRestricted
+	// ProfileRateLimited はツイートが制限されている状態です。
+	ProfileRateLimited
+	// ProfileMaintenance はメンテナンス中の状態です。
+	ProfileMaintenance
+)
+
+// ProfileTemplate は状態ごとのプロフィールのテンプレートです。
+// text/template の形式で、.Name .Description .Location に元のプロフィールが入ります。
+// 空のフィールドは元のプロフィールのまま変更しません。
+// APIでは空に戻すことができないため、元のプロフィールで空のフィールドも変更しません。
+type ProfileTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Location    string `json:"location"`
+}
+
+// Profile はBotのプロフィールのうち、状態によって変更する項目です。
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Location    string `json:"location"`
+}
+
+// defaultRateLimitedName はツイートの制限中のテンプレートが設定されていない場合の名前です。
+const defaultRateLimitedName = "{{.Name}}@ツイート制限中"
+
+// profileStatus はBotの状態をプロフィールに反映します。
+// 更新に失敗した場合は、時間を空けて成功するまで再び試みます。
+type profileStatus struct {
+	api   TwitterAPI
+	state StateStore
+
+	mu        sync.Mutex
+	templates map[ProfileState]ProfileTemplate
+	original  Profile
+	states    map[ProfileState]bool
+	applied   Profile
+
+	changed chan struct{}
+}
+
+func newProfileStatus(config Config, api TwitterAPI, state StateStore, user *twitter.User) *profileStatus {
+	current := Profile{Name: user.Name, Description: user.Description, Location: user.Location}
+
+	p := &profileStatus{
+		api:       api,
+		state:     state,
+		templates: profileTemplates(config),
+		original:  current,
+		states:    make(map[ProfileState]bool),
+		applied:   current,
+		changed:   make(chan struct{}, 1),
+	}
+
+	// If the bot was stopped while showing some state, the profile fetched now is not the original one.
+	if raw, err := state.Get(OriginalProfile); err == nil {
+		var original Profile
+		if err := json.Unmarshal([]byte(raw), &original); err == nil {
+			p.original = original
+		}
+	} else if err != ErrStateNotFound {
+		sentry.CaptureException(err)
+	}
+	return p
+}
+
+func profileTemplates(config Config) map[ProfileState]ProfileTemplate {
+	templates := map[ProfileState]ProfileTemplate{
+		ProfileRestricted:  config.Profile.Restricted,
+		ProfileRateLimited: config.Profile.RateLimited,
+		ProfileMaintenance: config.Profile.Maintenance,
+	}
+	if templates[ProfileRateLimited] == (ProfileTemplate{}) {
+		templates[ProfileRateLimited] = ProfileTemplate{Name: defaultRateLimitedName}
+	}
+	return templates
+}
+
+// SetTemplates は設定のテンプレートに置き換えます。プロフィールは非同期で更新されます。
+func (p *profileStatus) SetTemplates(config Config) {
+	p.mu.Lock()
+	p.templates = profileTemplates(config)
+	p.mu.Unlock()
+	p.notify()
+}
+
+// Set は状態を有効、または無効にします。プロフィールは非同期で更新されます。
+func (p *profileStatus) Set(state ProfileState, active bool) {
+	p.mu.Lock()
+	changed := p.states[state] != active
+	p.states[state] = active
+	p.mu.Unlock()
+
+	if changed {
+		p.notify()
+	}
+}
+
+func (p *profileStatus) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// current は現在表示されている状態を返します。
+func (p *profileStatus) current() ProfileState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for state := ProfileMaintenance; state > ProfileNormal; state-- {
+		if p.states[state] {
+			return state
+		}
+	}
+	return ProfileNormal
+}
+
+// desired は現在の状態で表示するべきプロフィールを返します。
+func (p *profileStatus) desired() (Profile, error) {
+	state := p.current()
+	p.mu.Lock()
+	original := p.original
+	t := p.templates[state]
+	p.mu.Unlock()
+
+	if state == ProfileNormal {
+		return original, nil
+	}
+
+	profile := original
+	for _, f := range []struct {
+		text string
+		dst  *string
+	}{
+		{t.Name, &profile.Name},
+		{t.Description, &profile.Description},
+		{t.Location, &profile.Location},
+	} {
+		if f.text == "" || *f.dst == "" {
+			continue
+		}
+		rendered, err := renderProfileTemplate(f.text, original)
+		if err != nil {
+			return original, err
+		}
+		if rendered != "" {
+			*f.dst = rendered
+		}
+	}
+	return profile, nil
+}
+
+func renderProfileTemplate(text string, original Profile) (string, error) {
+	t, err := template.New("profile").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, original); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// apply はプロフィールを表示するべき内容に更新します。
+func (p *profileStatus) apply() error {
+	profile, err := p.desired()
+	if err != nil {
+		return fmt.Errorf("invalid profile template: %s", err)
+	}
+
+	p.mu.Lock()
+	applied, original := p.applied, p.original
+	p.mu.Unlock()
+	if profile == applied {
+		return nil
+	}
+
+	// The API ignores empty fields, so the profile would silently stay as it is.
+	// Fail instead of forgetting the original profile that is not restored yet.
+	for _, f := range []struct {
+		name             string
+		value, displayed string
+	}{
+		{"name", profile.Name, applied.Name},
+		{"description", profile.Description, applied.Description},
+		{"location", profile.Location, applied.Location},
+	} {
+		if f.value == "" && f.displayed != "" {
+			return fmt.Errorf("could not clear %s of profile, since the API ignores empty fields", f.name)
+		}
+	}
+
+	// Remember the original profile before changing, to restore it even after restarting.
+	if profile != original {
+		raw, _ := json.Marshal(original)
+		if err := p.state.Set(OriginalProfile, string(raw), 0); err != nil {
+			return err
+		}
+	}
+
+	params := &twitter.AccountProfileParams{
+		IncludeEntities: twitter.Bool(false),
+		SkipStatus:      twitter.Bool(true),
+	}
+	if profile.Name != applied.Name {
+		params.Name = profile.Name
+	}
+	if profile.Description != applied.Description {
+		params.Description = profile.Description
+	}
+	if profile.Location != applied.Location {
+		params.Location = profile.Location
+	}
+	if _, _, err := p.api.UpdateProfile(params); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.applied = profile
+	p.mu.Unlock()
+
+	if profile == original {
+		_ = p.state.Del(OriginalProfile)
+	}
+	logger.WithFields(logrus.Fields{
+		"component": "profile",
+		"name":      profile.Name,
+	}).Info("Updated profile")
+	return nil
+}
+
+// run は状態が変わるたびにプロフィールを更新します。stop が閉じられると戻ります。
+// 時間によって変わる状態は profileCheckInterval ごとに isTimeRestricting と isReplyBlocked で確かめ直します。
+func (p *profileStatus) run(stop <-chan struct{}, isTimeRestricting, isReplyBlocked func() bool) {
+	ticker := time.NewTicker(profileCheckInterval)
+	defer ticker.Stop()
+
+	var retry <-chan time.Time
+	backoff := time.Second
+
+	// Restore the original profile if the bot was stopped while showing some state.
+	p.notify()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.changed:
+		case <-retry:
+		case <-ticker.C:
+			p.Set(ProfileRestricted, isTimeRestricting())
+			p.Set(ProfileRateLimited, isReplyBlocked())
+			continue
+		}
+
+		if err := p.apply(); err != nil {
+			sentry.CaptureException(fmt.Errorf("error occurred while updating profile, retrying in %s: %s", backoff, err))
+			retry = time.After(backoff)
+			backoff *= 2
+			if backoff > profileRetryMax {
+				backoff = profileRetryMax
+			}
+			continue
+		}
+		retry = nil
+		backoff = time.Second
+	}
+}
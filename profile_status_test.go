@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+func TestProfileStatusRestoreEmptyFields(t *testing.T) {
+	user := replayBotUser
+	user.Name = "tomobotter"
+	user.Description = ""
+	user.Location = "Tokyo"
+	fake := NewFakeTwitterClient(user)
+	state := NewMemoryStateStore(newTestClock().now)
+
+	var config Config
+	config.Profile.RateLimited = ProfileTemplate{
+		Name:        "{{.Name}}@制限中",
+		Description: "ツイートが制限されています",
+		Location:    "{{.Location}} (制限中)",
+	}
+	p := newProfileStatus(config, fake, state, &user)
+
+	p.Set(ProfileRateLimited, true)
+	if err := p.apply(); err != nil {
+		t.Fatal(err)
+	}
+	// 元のプロフィールで空の説明は、戻せないため変更しません。
+	if want := (Profile{Name: "tomobotter@制限中", Location: "Tokyo (制限中)"}); p.applied != want {
+		t.Errorf("applied = %+v, want %+v", p.applied, want)
+	}
+	if _, err := state.Get(OriginalProfile); err != nil {
+		t.Errorf("Get(OriginalProfile) while limited: %v", err)
+	}
+
+	p.Set(ProfileRateLimited, false)
+	if err := p.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.User.Name != "tomobotter" || fake.User.Description != "" || fake.User.Location != "Tokyo" {
+		t.Errorf("profile after restore = %q, %q, %q", fake.User.Name, fake.User.Description, fake.User.Location)
+	}
+	if _, err := state.Get(OriginalProfile); err != ErrStateNotFound {
+		t.Errorf("Get(OriginalProfile) after restore: err = %v, want ErrStateNotFound", err)
+	}
+}
+
+func TestProfileStatusCannotClearField(t *testing.T) {
+	// 空の説明に戻せないまま、前回の終了時に制限中の説明が残っていたものです。
+	user := replayBotUser
+	user.Name = "tomobotter@制限中"
+	user.Description = "ツイートが制限されています"
+	fake := NewFakeTwitterClient(user)
+	state := NewMemoryStateStore(newTestClock().now)
+	raw, _ := json.Marshal(Profile{Name: "tomobotter"})
+	if err := state.Set(OriginalProfile, string(raw), 0); err != nil {
+		t.Fatal(err)
+	}
+	p := newProfileStatus(Config{}, fake, state, &user)
+
+	if err := p.apply(); err == nil {
+		t.Error("apply clearing the description: err = nil")
+	}
+	if profiles := fake.SentProfiles(); len(profiles) != 0 {
+		t.Errorf("sent profiles = %+v, want none", profiles)
+	}
+	if got, err := state.Get(OriginalProfile); err != nil || got != string(raw) {
+		t.Errorf("Get(OriginalProfile) = %q, %v, want the original profile kept", got, err)
+	}
+}
+
+func TestFakeUpdateProfileIgnoresEmptyFields(t *testing.T) {
+	fake := NewFakeTwitterClient(twitter.User{Name: "a", Description: "b", Location: "c"})
+	if _, _, err := fake.UpdateProfile(&twitter.AccountProfileParams{Name: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.User.Name != "x" || fake.User.Description != "b" || fake.User.Location != "c" {
+		t.Errorf("profile = %q, %q, %q, want the empty fields unchanged", fake.User.Name, fake.User.Description, fake.User.Location)
+	}
+}
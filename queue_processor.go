@@ -1,206 +1,446 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
-	"github.com/go-redis/redis"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
+var (
+	// ErrTweetNotFound はツイートが存在しない場合のエラーです。
+	// statuses/lookup では削除されたツイートと非公開のアカウントのツイートを区別できないため、どちらもこのエラーになります。
+	ErrTweetNotFound = errors.New("tweet not found")
+	// ErrTweetProtected は非公開のアカウントのツイートのため取得できない場合のエラーです。
+	ErrTweetProtected = errors.New("tweet is protected")
+)
+
+const (
+	// lookupTimeout はツイートの検索を待つ最大の時間です。
+	lookupTimeout = 30 * time.Second
+
+	// maxLookupIDs は statuses/lookup に一度に指定できるIDの最大の数です。
+	maxLookupIDs = 100
+
+	// minLookupInterval はキューに100件未満しかない場合の検索の最小の間隔です。
+	minLookupInterval = 1 * time.Second
+	// fullBatchInterval はキューに100件以上ある場合の検索の最小の間隔です。
+	fullBatchInterval = 100 * time.Millisecond
+	// maxLookupInterval は残りの回数が少ない場合の検索の最大の間隔です。
+	maxLookupInterval = 10 * time.Second
+)
+
 type lookupQueue struct {
-	ticker    *time.Ticker
-	executing bool
+	api     TwitterAPI
+	budgets *apiBudgets
+	cache   *tweetCache
 
-	queue *Queue
+	mu      sync.Mutex
+	waiters map[int64][]chan lookupResult
+	// order は追加された順番のIDです。古いものから検索します。
+	order []int64
 }
 
-type Callback func(tweet twitter.Tweet)
-type Queue map[int64][]Callback
+// lookupResult はツイートの検索の結果です。
+type lookupResult struct {
+	tweet twitter.Tweet
+	err   error
+}
 
-func NewLookupQueue() *lookupQueue {
-	queue := make(Queue)
+func NewLookupQueue(api TwitterAPI, state StateStore, cache *tweetCache) *lookupQueue {
 	return &lookupQueue{
-		ticker: time.NewTicker(1 * time.Second),
-		queue:  &queue,
+		api:     api,
+		budgets: newAPIBudgets(state),
+		cache:   cache,
+		waiters: make(map[int64][]chan lookupResult),
 	}
 }
 
-func (t *lookupQueue) LookupTweetBlocking(id int64) twitter.Tweet {
-	tc := make(chan twitter.Tweet, 1)
+// LookupTweet はツイートをキューに追加し、検索されるまで待ちます。キャッシュにある場合はすぐに返します。
+// ツイートが見つからない場合は ErrTweetNotFound か ErrTweetProtected を返します。
+// ctx が終了した場合はキューから取り除き、ctx.Err() を返します。
+func (t *lookupQueue) LookupTweet(ctx context.Context, id int64) (twitter.Tweet, error) {
+	if r, ok := t.cache.Get(id); ok {
+		return r.tweet, r.err
+	}
 
-	t.EnqueueLookupHandler(id, func(tweet twitter.Tweet) {
-		tc <- tweet
-	})
+	c := make(chan lookupResult, 1)
+	start := time.Now()
+
+	t.mu.Lock()
+	if len(t.waiters[id]) == 0 {
+		t.order = append(t.order, id)
+	}
+	t.waiters[id] = append(t.waiters[id], c)
+	t.mu.Unlock()
 
-	tweet, ok := <-tc
-	if !ok {
-		panic("unrecoverable panic occurred: channel unexpectedly closed while looking up tweet")
+	select {
+	case r := <-c:
+		lookupDuration.WithLabelValues(lookupResultLabel(r.err)).Observe(time.Since(start).Seconds())
+		return r.tweet, r.err
+	case <-ctx.Done():
+		t.cancel(id, c)
+		lookupDuration.WithLabelValues("canceled").Observe(time.Since(start).Seconds())
+		return twitter.Tweet{}, ctx.Err()
 	}
-	return tweet
 }
 
-// EnqueueLookupHandler はキューに検索するIDとツイートを処理するコールバックを追加します
-func (t *lookupQueue) EnqueueLookupHandler(id int64, handler Callback) {
-	(*t.queue)[id] = append((*t.queue)[id], handler)
+// lookupTweet は lookupTimeout まで待ってツイートを検索します。検索の結果は hub にパンくずとして残します。
+func (b *Bot) lookupTweet(hub *sentry.Hub, id int64) (twitter.Tweet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	tweet, err := b.lookupQueue.LookupTweet(ctx, id)
+	addLookupBreadcrumb(hub, id, err)
+	return tweet, err
 }
 
-// StartTicker は1秒間に一度キューの中身をすべて検索にかけ、コールバックを呼びます
-func (t *lookupQueue) StartTicker() {
-	for n := range t.ticker.C {
-		go t.Execute(n)
+func addLookupBreadcrumb(hub *sentry.Hub, id int64, err error) {
+	breadcrumb := &sentry.Breadcrumb{
+		Category: "lookup",
+		Message:  "Looked up tweet " + strconv.FormatInt(id, 10),
+		Data:     map[string]interface{}{"result": lookupResultLabel(err)},
+	}
+	if err != nil && err != ErrTweetNotFound && err != ErrTweetProtected {
+		breadcrumb.Level = sentry.LevelError
+		breadcrumb.Data["error"] = err.Error()
 	}
+	hub.AddBreadcrumb(breadcrumb, nil)
 }
 
-func (t *lookupQueue) Execute(n time.Time) {
-	if t.executing {
-		sentry.CaptureMessage("called progress function during executing")
-		return
+// lookupTweets は複数のツイートを同時に検索し、ids と同じ順番で結果を返します。
+func (b *Bot) lookupTweets(hub *sentry.Hub, ids []int64) []lookupResult {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	results := make([]lookupResult, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id int64) {
+			defer wg.Done()
+			tweet, err := b.lookupQueue.LookupTweet(ctx, id)
+			results[i] = lookupResult{tweet: tweet, err: err}
+		}(i, id)
 	}
+	wg.Wait()
 
-	t.executing = true
-	defer func() {
-		t.executing = false
-	}()
+	for i, r := range results {
+		addLookupBreadcrumb(hub, ids[i], r.err)
+	}
+	return results
+}
+
+// showTweet は statuses/show/:id でツイートをすぐに検索します。キャッシュにある場合はキャッシュを返します。
+// statuses/lookup と違い、非公開のアカウントのツイートの場合は ErrTweetProtected を返します。
+func (b *Bot) showTweet(hub *sentry.Hub, id int64) (twitter.Tweet, error) {
+	t := b.lookupQueue
+	if r, ok := t.cache.Get(id); ok {
+		addLookupBreadcrumb(hub, id, r.err)
+		return r.tweet, r.err
+	}
 
-	// Check for redis rate limit.
-	resetStr, err := redisClient.Get(ShowRateLimitReset).Result()
+	// Do not spend a call that is known to fail. The queue would wait for the reset, but this is a direct reply.
+	now := b.now()
+	budget, err := t.budgets.Get(EndpointStatusesShow, now)
+	if err == nil && budget.Exhausted(now) {
+		err = fmt.Errorf("API /statuses/show/:id is rate limited until %s", budget.Reset.Format(time.RFC3339))
+	}
 	if err != nil {
-		if err != redis.Nil {
-			sentry.CaptureException(err)
-			return // DO NOT execute statuses/lookup if redis is down!
+		addLookupBreadcrumb(hub, id, err)
+		return twitter.Tweet{}, err
+	}
+
+	var r lookupResult
+	t.show([]int64{id}, now, func(_ int64, result lookupResult) {
+		t.store(id, result)
+		r = result
+	})
+	if r.err == nil && r.tweet.ID == 0 {
+		r.err = errors.New("API /statuses/show/:id exceeded rate limit")
+	}
+	addLookupBreadcrumb(hub, id, r.err)
+	return r.tweet, r.err
+}
+
+// cancel は待つのをやめた呼び出し元をキューから取り除きます。
+func (t *lookupQueue) cancel(id int64, c chan lookupResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	waiters := t.waiters[id]
+	for i, w := range waiters {
+		if w == c {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
 		}
+	}
+	if len(waiters) == 0 {
+		delete(t.waiters, id) // The id left in order is skipped by take.
 	} else {
-		if reset, err := strconv.ParseInt(resetStr, 10, 64); err == nil {
-			if reset > n.Unix() {
-				return // rate limited!
-			}
-		} else {
-			sentry.CaptureException(fmt.Errorf("not int64 value (%s) passed by redis with key %s", resetStr, ShowRateLimitReset))
+		t.waiters[id] = waiters
+	}
+}
 
-			// Reset the value of redis
-			redisClient.Del(ShowRateLimitReset)
+// Len はキューにあるIDの数を返します。
+func (t *lookupQueue) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.waiters)
+}
+
+// take はキューから古い順に最大 max 件のIDを取り出します。
+func (t *lookupQueue) take(max int) ([]int64, map[int64][]chan lookupResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]int64, 0, max)
+	queue := make(map[int64][]chan lookupResult, max)
+	i := 0
+	for ; i < len(t.order) && len(ids) < max; i++ {
+		id := t.order[i]
+		waiters, ok := t.waiters[id]
+		if !ok {
+			continue // Already taken or canceled.
 		}
+		ids = append(ids, id)
+		queue[id] = waiters
+		delete(t.waiters, id)
 	}
+	t.order = t.order[i:]
+	return ids, queue
+}
 
-	// Move queue here
-	queue := *t.queue
+// requeue は検索できなかったIDを次の検索のためにキューの先頭へ戻します。
+func (t *lookupQueue) requeue(queue map[int64][]chan lookupResult, ids []int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	if len(queue) == 0 {
-		return // queue is still empty then do nothing.
+	order := make([]int64, 0, len(ids)+len(t.order))
+	for _, id := range ids {
+		waiters, ok := queue[id]
+		if !ok {
+			continue
+		}
+		if _, queued := t.waiters[id]; !queued {
+			order = append(order, id)
+		}
+		t.waiters[id] = append(waiters, t.waiters[id]...)
 	}
+	t.order = append(order, t.order...)
+}
 
-	// and re-create
-	newQueue := make(Queue)
-	t.queue = &newQueue
+// Run はキューの中身を検索にかけ、結果を待っている呼び出し元に返します。
+// 検索の間隔はキューの長さと残りの呼び出し回数から決めます。stop が閉じられると戻ります。
+func (t *lookupQueue) Run(stop <-chan struct{}) {
+	for {
+		t.Execute(time.Now())
+		lookupQueueDepth.Set(float64(t.Len()))
 
-	// Make the list of ids for lookup
-	ids := make([]int64, 0, len(queue))
-	for id := range queue {
-		ids = append(ids, id)
+		timer := time.NewTimer(t.nextInterval(time.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextInterval は次に検索するまでの間隔を返します。
+// 残りの回数をリセットまで均等に使い、キューに100件以上ある場合はより短い間隔で検索します。
+func (t *lookupQueue) nextInterval(now time.Time) time.Duration {
+	depth := t.Len()
+	if depth == 0 {
+		return minLookupInterval
+	}
+
+	lookup, err := t.budgets.Get(EndpointStatusesLookup, now)
+	if err != nil {
+		return maxLookupInterval
+	}
+	if lookup.Exhausted(now) {
+		show, err := t.budgets.Get(EndpointStatusesShow, now)
+		if err != nil {
+			return maxLookupInterval
+		}
+		if !show.Exhausted(now) {
+			return minLookupInterval // Fallback to statuses/show.
+		}
+		reset := lookup.Reset
+		if show.Reset.Before(reset) {
+			reset = show.Reset
+		}
+		return reset.Sub(now)
 	}
 
-	log.Printf("Looking up tweet(s): %v\n", ids)
+	min := minLookupInterval
+	if depth >= maxLookupIDs {
+		min = fullBatchInterval
+	}
+	interval := lookup.pace(now)
+	if interval < min {
+		interval = min
+	}
+	if interval > maxLookupInterval {
+		interval = maxLookupInterval
+	}
+	return interval
+}
 
-	// fallback to the statuses/show endpoint if statuses/lookup endpoint is exceeded rate limit.
-	fallbackToShow := false
+// Execute はキューから最大100件のIDを取り出して検索します。
+// statuses/lookup の制限を超えている場合は、statuses/show の残りの回数の分だけ1件ずつ検索します。
+func (t *lookupQueue) Execute(n time.Time) {
+	lookup, err := t.budgets.Get(EndpointStatusesLookup, n)
+	if err != nil {
+		sentry.CaptureException(err)
+		return // DO NOT call the API if redis is down!
+	}
+	show, err := t.budgets.Get(EndpointStatusesShow, n)
+	if err != nil {
+		sentry.CaptureException(err)
+		return
+	}
+
+	max := maxLookupIDs
+	if lookup.Exhausted(n) {
+		if show.Exhausted(n) {
+			return // rate limited!
+		}
+		if show.Known() && show.Remaining < max {
+			max = show.Remaining
+		}
+	}
 
-	tweets, resp, err := client.Statuses.Lookup(ids, &twitter.StatusLookupParams{
-		TrimUser:        twitter.Bool(true),
+	ids, queue := t.take(max)
+	if len(ids) == 0 {
+		return // queue is still empty then do nothing.
+	}
+
+	deliver := func(id int64, r lookupResult) {
+		t.store(id, r)
+		for _, c := range queue[id] {
+			c <- r // Buffered, never blocks.
+		}
+		delete(queue, id)
+	}
+	defer func() {
+		// The rest will be looked up after the rate limit is reset.
+		if len(queue) > 0 {
+			t.requeue(queue, ids)
+		}
+	}()
+
+	if lookup.Exhausted(n) {
+		t.show(ids, n, deliver)
+		return
+	}
+
+	log := logger.WithField("component", "lookup_queue")
+	log.WithField("ids", ids).Debug("Looking up tweets")
+	lookupBatchSize.WithLabelValues(EndpointStatusesLookup).Observe(float64(len(ids)))
+
+	tweets, resp, err := t.api.LookupTweets(ids, &twitter.StatusLookupParams{
+		TrimUser:        twitter.Bool(false),
 		IncludeEntities: twitter.Bool(true),
 		TweetMode:       "extended",
 	})
+	if e := t.budgets.Record(EndpointStatusesLookup, resp, n); e != nil {
+		sentry.CaptureException(e)
+	}
 	if err != nil {
-		if resp != nil {
-			if err.(twitter.APIError).Errors[0].Code == 88 {
-				sentry.CaptureMessage("API /statuses/lookup somehow exceeded rate limit!")
-				fallbackToShow = true
-			} else {
-				sentry.CaptureException(fmt.Errorf("non rate limit error occurred while calling /statuses/lookup: %s", err))
-				return
+		if resp != nil && apiErrorCode(err) == 88 {
+			// fallback to the statuses/show endpoint if statuses/lookup endpoint is exceeded rate limit.
+			sentry.CaptureMessage("API /statuses/lookup somehow exceeded rate limit!")
+			if e := t.budgets.Exhaust(EndpointStatusesLookup, resp, n); e != nil {
+				sentry.CaptureException(e)
 			}
-		} else {
-			sentry.CaptureException(fmt.Errorf("connection error occurred while calling /statuses/lookup: %s", err))
+			if show.Known() && show.Remaining < len(ids) {
+				ids = ids[:show.Remaining]
+			}
+			t.show(ids, n, deliver)
 			return
 		}
-	}
 
-	if fallbackToShow {
+		if resp != nil {
+			err = fmt.Errorf("non rate limit error occurred while calling /statuses/lookup: %s", err)
+		} else {
+			err = fmt.Errorf("connection error occurred while calling /statuses/lookup: %s", err)
+		}
+		sentry.CaptureException(err)
 		for _, id := range ids {
-			tweet, resp, err := client.Statuses.Show(id, &twitter.StatusShowParams{
-				TrimUser:         twitter.Bool(true),
-				IncludeMyRetweet: twitter.Bool(false),
-				IncludeEntities:  twitter.Bool(true),
-				TweetMode:        "extended",
-			})
-			if err != nil {
-				if resp != nil {
-					if err.(twitter.APIError).Errors[0].Code == 88 { // Rate limit exceeded
-						sentry.CaptureMessage("API /statuses/show/:id exceeded rate limit!")
-						redisClient.Set(ShowRateLimitReset, resp.Header.Get("x-rate-limit-reset"), 0)
-						break // Process only the retrieved tweets.
-					}
-					if resp.StatusCode == 404 { // Tweet already deleted.
-						continue
-					}
-				}
-				sentry.CaptureException(fmt.Errorf("error occurred while calling /statuses/show: %s", err))
-				continue
-			}
-
-			tweets = append(tweets, *tweet)
+			deliver(id, lookupResult{err: err})
 		}
+		return
 	}
 
-	foundIds := make([]int64, 0, len(ids))
-
-	// Calling callbacks!
-	// Ignore tweet that already deleted.
-	var wg sync.WaitGroup
 	for _, tweet := range tweets {
-		foundIds = append(foundIds, tweet.ID)
-		cbs := queue[tweet.ID]
+		deliver(tweet.ID, lookupResult{tweet: tweet})
+	}
 
-		for _, cb := range cbs {
-			wg.Add(1)
-			go func(tweet twitter.Tweet, cb Callback) {
-				defer wg.Done()
-				cb(tweet)
-			}(tweet, cb)
+	if len(queue) > 0 {
+		notFound := make([]int64, 0, len(queue))
+		for _, id := range ids {
+			if _, ok := queue[id]; ok {
+				notFound = append(notFound, id)
+				deliver(id, lookupResult{err: ErrTweetNotFound})
+			}
 		}
+		log.WithField("ids", notFound).Info("Could not fetch tweets")
 	}
-	// wait until all of worker goroutines (callback caller) done.
-	wg.Wait()
+}
+
+// store は検索の結果をキャッシュします。一時的なエラーはキャッシュしません。
+func (t *lookupQueue) store(id int64, r lookupResult) {
+	if r.err != nil {
+		t.cache.SetError(id, r.err)
+	} else {
+		t.cache.Set(r.tweet)
+	}
+}
 
-	if len(foundIds) < len(ids) {
-		w := bufio.NewWriterSize(os.Stdout, 512)
-		_, _ = w.WriteString("Could not fetch tweet(s): [")
-
-		// writing the difference of ids and foundIds to stdout
-		// ref. https://stackoverflow.com/questions/19374219/how-to-find-the-difference-between-two-slices-of-strings
-		for _, s1 := range ids {
-			found := false
-			for _, s2 := range foundIds {
-				if s1 == s2 {
-					found = true
-					break
+// show は statuses/show/:id で1件ずつツイートを検索します。
+// 制限を超えた場合は、残りのIDを検索せずに戻ります。残りの回数は now の時点のものとして記録します。
+func (t *lookupQueue) show(ids []int64, now time.Time, deliver func(int64, lookupResult)) {
+	lookupBatchSize.WithLabelValues(EndpointStatusesShow).Observe(float64(len(ids)))
+	for _, id := range ids {
+		tweet, resp, err := t.api.ShowTweet(id, &twitter.StatusShowParams{
+			TrimUser:         twitter.Bool(false),
+			IncludeMyRetweet: twitter.Bool(false),
+			IncludeEntities:  twitter.Bool(true),
+			TweetMode:        "extended",
+		})
+		if e := t.budgets.Record(EndpointStatusesShow, resp, now); e != nil {
+			sentry.CaptureException(e)
+		}
+		if err != nil {
+			if resp != nil {
+				switch apiErrorCode(err) {
+				case 88: // Rate limit exceeded
+					sentry.CaptureMessage("API /statuses/show/:id exceeded rate limit!")
+					if e := t.budgets.Exhaust(EndpointStatusesShow, resp, now); e != nil {
+						sentry.CaptureException(e)
+					}
+					return
+				case 179: // Protected
+					deliver(id, lookupResult{err: ErrTweetProtected})
+					continue
+				}
+				if resp.StatusCode == 404 { // Tweet already deleted.
+					deliver(id, lookupResult{err: ErrTweetNotFound})
+					continue
 				}
 			}
-			// String not found. We add it to return slice
-			if !found {
-				// TODO: faster way to write int64 to buffer without casting to string.
-				_, _ = w.WriteString(string(s1))
-			}
+			err = fmt.Errorf("error occurred while calling /statuses/show: %s", err)
+			sentry.CaptureException(err)
+			deliver(id, lookupResult{err: err})
+			continue
 		}
-		_, _ = w.WriteRune(']')
 
-		// Now print to stdout!
-		_ = w.Flush()
+		deliver(id, lookupResult{tweet: *tweet})
 	}
 }
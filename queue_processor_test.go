@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// newTestLookupQueue は fake を検索する、メモリ上のキャッシュと残りの回数を使うキューを作成します。
+// レスポンスヘッダーのリセットの時間と比べるため、時刻は time.Now を使います。
+func newTestLookupQueue(fake *FakeTwitterClient) *lookupQueue {
+	return NewLookupQueue(fake, NewMemoryStateStore(time.Now), newTweetCache(Config{}, nil))
+}
+
+func newLookupTestClient() *FakeTwitterClient {
+	fake := NewFakeTwitterClient(replayBotUser)
+	fake.AddTweet(twitter.Tweet{ID: 1, FullText: "found"})
+	fake.AddTweet(twitter.Tweet{ID: 2, FullText: "protected"})
+	fake.AddProtectedTweet(2)
+	return fake
+}
+
+// lookupAsync は LookupTweet をゴルーチンで呼び出し、キューに追加されるまで待ちます。
+func lookupAsync(t *testing.T, ctx context.Context, q *lookupQueue, id int64) <-chan lookupResult {
+	t.Helper()
+	q.mu.Lock()
+	before := len(q.waiters[id])
+	q.mu.Unlock()
+
+	c := make(chan lookupResult, 1)
+	go func() {
+		tweet, err := q.LookupTweet(ctx, id)
+		c <- lookupResult{tweet: tweet, err: err}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		q.mu.Lock()
+		n := len(q.waiters[id])
+		q.mu.Unlock()
+		if n > before {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LookupTweet(%d) was not queued", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receiveLookup(t *testing.T, c <-chan lookupResult) lookupResult {
+	t.Helper()
+	select {
+	case r := <-c:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("LookupTweet did not return")
+		return lookupResult{}
+	}
+}
+
+// testRateLimitResponse は残りの回数とリセットの時間を含むレスポンスです。
+func testRateLimitResponse(remaining int, reset time.Time) *http.Response {
+	resp := fakeResponse(http.StatusOK)
+	resp.Header.Set("x-rate-limit-remaining", strconv.Itoa(remaining))
+	resp.Header.Set("x-rate-limit-reset", strconv.FormatInt(reset.Unix(), 10))
+	return resp
+}
+
+func TestLookupQueueDeliversToEveryWaiter(t *testing.T) {
+	fake := newLookupTestClient()
+	q := newTestLookupQueue(fake)
+	ctx := context.Background()
+
+	waiters := map[int64][]<-chan lookupResult{}
+	for _, id := range []int64{1, 1, 2, 2, 3} {
+		waiters[id] = append(waiters[id], lookupAsync(t, ctx, q, id))
+	}
+	q.Execute(time.Now())
+
+	// statuses/lookup では削除されたツイートと非公開のツイートを区別できません。
+	want := map[int64]error{1: nil, 2: ErrTweetNotFound, 3: ErrTweetNotFound}
+	for id, cs := range waiters {
+		for _, c := range cs {
+			r := receiveLookup(t, c)
+			if r.err != want[id] || (r.err == nil && r.tweet.ID != id) {
+				t.Errorf("LookupTweet(%d) = %d, %v, want %v", id, r.tweet.ID, r.err, want[id])
+			}
+		}
+	}
+	if n := fake.LookupCalls(); n != 1 {
+		t.Errorf("LookupCalls = %d, want 1", n)
+	}
+
+	// 見つからなかったことも含めて、結果はキャッシュされます。
+	for id, err := range want {
+		if _, got := q.LookupTweet(ctx, id); got != err {
+			t.Errorf("cached LookupTweet(%d): err = %v, want %v", id, got, err)
+		}
+	}
+	if n := fake.LookupCalls(); n != 1 {
+		t.Errorf("LookupCalls after cached lookups = %d, want 1", n)
+	}
+}
+
+func TestLookupQueueFallbackToShow(t *testing.T) {
+	fake := newLookupTestClient()
+	fake.SetLookupErrorCode(88)
+	q := newTestLookupQueue(fake)
+	ctx := context.Background()
+
+	waiters := map[int64][]<-chan lookupResult{}
+	for _, id := range []int64{1, 2, 2, 3} {
+		waiters[id] = append(waiters[id], lookupAsync(t, ctx, q, id))
+	}
+	q.Execute(time.Now())
+
+	// statuses/show では非公開のツイートを区別できます。
+	want := map[int64]error{1: nil, 2: ErrTweetProtected, 3: ErrTweetNotFound}
+	for id, cs := range waiters {
+		for _, c := range cs {
+			if r := receiveLookup(t, c); r.err != want[id] || (r.err == nil && r.tweet.ID != id) {
+				t.Errorf("LookupTweet(%d) = %d, %v, want %v", id, r.tweet.ID, r.err, want[id])
+			}
+		}
+	}
+	if lookups, shows := fake.LookupCalls(), fake.ShowCalls(); lookups != 1 || shows != 3 {
+		t.Errorf("LookupCalls, ShowCalls = %d, %d, want 1, 3", lookups, shows)
+	}
+
+	// 次からは statuses/lookup を呼ばずに statuses/show を使います。
+	c := lookupAsync(t, ctx, q, 4)
+	q.Execute(time.Now())
+	if r := receiveLookup(t, c); r.err != ErrTweetNotFound {
+		t.Errorf("LookupTweet(4): err = %v, want ErrTweetNotFound", r.err)
+	}
+	if lookups, shows := fake.LookupCalls(), fake.ShowCalls(); lookups != 1 || shows != 4 {
+		t.Errorf("LookupCalls, ShowCalls after exhausted = %d, %d, want 1, 4", lookups, shows)
+	}
+}
+
+func TestLookupQueueCancel(t *testing.T) {
+	fake := newLookupTestClient()
+	q := newTestLookupQueue(fake)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := lookupAsync(t, ctx, q, 1)
+	waiting := lookupAsync(t, context.Background(), q, 1)
+	cancel()
+	if r := receiveLookup(t, canceled); r.err != context.Canceled {
+		t.Errorf("canceled LookupTweet: err = %v, want context.Canceled", r.err)
+	}
+	// 他の呼び出し元が待っている間は、キューに残ります。
+	if n := q.Len(); n != 1 {
+		t.Errorf("Len after one waiter canceled = %d, want 1", n)
+	}
+	q.Execute(time.Now())
+	if r := receiveLookup(t, waiting); r.err != nil || r.tweet.ID != 1 {
+		t.Errorf("remaining LookupTweet = %d, %v, want the tweet", r.tweet.ID, r.err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	canceled = lookupAsync(t, ctx, q, 3)
+	cancel()
+	receiveLookup(t, canceled)
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len after every waiter canceled = %d, want 0", n)
+	}
+	q.Execute(time.Now())
+	if n := fake.LookupCalls(); n != 1 {
+		t.Errorf("LookupCalls = %d, want the canceled id not looked up", n)
+	}
+}
+
+func TestLookupQueueTimeout(t *testing.T) {
+	q := newTestLookupQueue(newLookupTestClient())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := q.LookupTweet(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("LookupTweet without Execute: err = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("LookupTweet returned after %s", d)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len after timeout = %d, want 0", n)
+	}
+}
+
+func TestLookupQueueRequeue(t *testing.T) {
+	fake := newLookupTestClient()
+	fake.AddTweet(twitter.Tweet{ID: 3, FullText: "third"})
+	q := newTestLookupQueue(fake)
+	ctx := context.Background()
+
+	// statuses/lookup の制限を超え、statuses/show は残り1回です。
+	reset := time.Now().Add(apiRateLimitWindow)
+	if err := q.budgets.Record(EndpointStatusesLookup, testRateLimitResponse(0, reset), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.budgets.Record(EndpointStatusesShow, testRateLimitResponse(1, reset), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	first := lookupAsync(t, ctx, q, 1)
+	second := lookupAsync(t, ctx, q, 3)
+	q.Execute(time.Now())
+	if r := receiveLookup(t, first); r.err != nil || r.tweet.ID != 1 {
+		t.Errorf("LookupTweet(1) = %d, %v, want the tweet", r.tweet.ID, r.err)
+	}
+
+	// 検索できなかったIDは、後から追加されたIDより先に検索します。
+	third := lookupAsync(t, ctx, q, 4)
+	q.mu.Lock()
+	order := append([]int64(nil), q.order...)
+	q.mu.Unlock()
+	if want := []int64{3, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order after requeue = %v, want %v", order, want)
+	}
+
+	if err := q.budgets.Record(EndpointStatusesShow, testRateLimitResponse(10, reset), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	q.Execute(time.Now())
+	if r := receiveLookup(t, second); r.err != nil || r.tweet.ID != 3 {
+		t.Errorf("requeued LookupTweet(3) = %d, %v, want the tweet", r.tweet.ID, r.err)
+	}
+	if r := receiveLookup(t, third); r.err != ErrTweetNotFound {
+		t.Errorf("LookupTweet(4): err = %v, want ErrTweetNotFound", r.err)
+	}
+	if lookups, shows := fake.LookupCalls(), fake.ShowCalls(); lookups != 0 || shows != 3 {
+		t.Errorf("LookupCalls, ShowCalls = %d, %d, want 0, 3", lookups, shows)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Redis Key prefix, rate-limit:<command>:<user id>
+	RateLimitPrefix = "rate-limit:"
+
+	// unknownCommandRateLimit は存在しないコマンドへの返信に使う制限の名前です。制限は rate_limit.default に従います。
+	unknownCommandRateLimit = "unknown"
+)
+
+/*
+tokenBucketScript はトークンバケットから1回分を取り出します。
+
+KEYS[1]: バケットのキー
+ARGV[1]: バケットの容量
+ARGV[2]: 1回分が回復するまでのミリ秒
+ARGV[3]: 現在の時刻 (ミリ秒)
+
+{実行できるか, 制限されたことを通知するべきか, 次に実行できるまでのミリ秒} を返します。
+通知は制限されてから一度だけ行い、再び実行できるようになるとリセットされます。
+*/
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts', 'notified')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+local notified = bucket[3] == '1'
+
+local refill = math.floor((now - ts) / interval)
+if refill > 0 then
+	tokens = math.min(capacity, tokens + refill)
+	ts = ts + refill * interval
+end
+if tokens >= capacity then
+	ts = now
+end
+
+local allowed, notify = 0, 0
+if tokens > 0 then
+	tokens = tokens - 1
+	allowed = 1
+	notified = false
+elseif not notified then
+	notify = 1
+	notified = true
+end
+
+local notifiedValue = '0'
+if notified then
+	notifiedValue = '1'
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', ts, 'notified', notifiedValue)
+redis.call('PEXPIRE', KEYS[1], capacity * interval)
+
+return {allowed, notify, ts + interval - now}
+`)
+
+// rateLimiter はユーザーごとのトークンバケットを保存します。
+type rateLimiter interface {
+	// Take は key のバケットから1回分を取り出します。
+	// 制限されていて、まだそのことを通知していない場合は notify がtrueになります。
+	Take(key string, limit RateLimit, now time.Time) (allowed, notify bool, retryAfter time.Duration, err error)
+}
+
+// redisRateLimiter は tokenBucketScript でRedisにバケットを保存します。複数のプロセスで制限を共有できます。
+type redisRateLimiter struct {
+	redis *redis.Client
+}
+
+func newRedisRateLimiter(redisClient *redis.Client) rateLimiter {
+	return &redisRateLimiter{redis: redisClient}
+}
+
+func (l *redisRateLimiter) Take(key string, limit RateLimit, now time.Time) (bool, bool, time.Duration, error) {
+	res, err := tokenBucketScript.Run(l.redis, []string{key}, limit.Burst, limit.Interval*1000, unixMillis(now)).Result()
+	if err != nil {
+		return false, false, 0, err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 3 {
+		return false, false, 0, fmt.Errorf("unexpected result from rate limit script: %v", res)
+	}
+	allowedValue, _ := values[0].(int64)
+	notifyValue, _ := values[1].(int64)
+	retryValue, _ := values[2].(int64)
+
+	return allowedValue == 1, notifyValue == 1, time.Duration(retryValue) * time.Millisecond, nil
+}
+
+// memoryRateLimiter はメモリ上にバケットを保存します。tokenBucketScript と同じように動作します。
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens   int
+	ts       time.Time
+	notified bool
+	// expiresAt を過ぎると、満杯のバケットとして扱います。
+	expiresAt time.Time
+}
+
+func newMemoryRateLimiter() rateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *memoryRateLimiter) Take(key string, limit RateLimit, now time.Time) (bool, bool, time.Duration, error) {
+	capacity := limit.Burst
+	interval := time.Duration(limit.Interval) * time.Second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= memorySweepInterval {
+		for k, bucket := range l.buckets {
+			if !now.Before(bucket.expiresAt) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok || !now.Before(bucket.expiresAt) {
+		bucket = &tokenBucket{tokens: capacity, ts: now}
+		l.buckets[key] = bucket
+	}
+
+	if refill := int(now.Sub(bucket.ts) / interval); refill > 0 {
+		bucket.tokens += refill
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+		bucket.ts = bucket.ts.Add(time.Duration(refill) * interval)
+	}
+	if bucket.tokens >= capacity {
+		bucket.ts = now
+	}
+
+	allowed, notify := false, false
+	if bucket.tokens > 0 {
+		bucket.tokens--
+		allowed = true
+		bucket.notified = false
+	} else if !bucket.notified {
+		notify = true
+		bucket.notified = true
+	}
+	bucket.expiresAt = now.Add(time.Duration(capacity) * interval)
+
+	return allowed, notify, bucket.ts.Add(interval).Sub(now), nil
+}
+
+// takeRateLimit はユーザーがコマンドを実行できるかをトークンバケットで確かめます。
+// 制限されていて、まだそのことを通知していない場合は notify がtrueになります。
+// バケットを保存できない場合は常に実行を許可します。
+func (b *Bot) takeRateLimit(command string, userID int64) (allowed, notify bool, retryAfter time.Duration) {
+	limit := b.Config().RateLimitFor(command)
+	if limit.Burst <= 0 || limit.Interval <= 0 {
+		return true, false, 0
+	}
+
+	key := RateLimitPrefix + command + ":" + strconv.FormatInt(userID, 10)
+	allowed, notify, retryAfter, err := b.rateLimits.Take(key, limit, b.now())
+	if err != nil {
+		sentry.CaptureException(fmt.Errorf("error occurred while taking rate limit: %s", err))
+		return true, false, 0 // If error occurred on Redis, Try to execute.
+	}
+	return allowed, notify, retryAfter
+}
+
+func rateLimitedMessage(retryAfter time.Duration) string {
+	seconds := int64(retryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return "短時間に何度もコマンドが実行されたため、一時的に制限しています。" + strconv.FormatInt(seconds, 10) + "秒後にもう一度お試しください。"
+}
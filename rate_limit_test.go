@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// newTestRedis は環境変数 TOMOBOTTER_TEST_REDIS_ADDR のRedisに接続します。設定されていない場合はテストをスキップします。
+// キーが衝突しないように、データベース15を前後で空にして使います。
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("TOMOBOTTER_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TOMOBOTTER_TEST_REDIS_ADDR is not set")
+	}
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	client := redis.NewClient(&redis.Options{Network: network, Addr: addr, DB: 15})
+	if err := client.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.FlushDB()
+		client.Close()
+	})
+	return client
+}
+
+func TestRateLimiter(t *testing.T) {
+	drivers := []struct {
+		name string
+		new  func(t *testing.T) rateLimiter
+	}{
+		{"memory", func(*testing.T) rateLimiter { return newMemoryRateLimiter() }},
+		{"redis", func(t *testing.T) rateLimiter { return newRedisRateLimiter(newTestRedis(t)) }},
+	}
+	for _, driver := range drivers {
+		t.Run(driver.name, func(t *testing.T) {
+			testRateLimiter(t, driver.new(t))
+		})
+	}
+}
+
+func testRateLimiter(t *testing.T, limiter rateLimiter) {
+	clock := newTestClock()
+	limit := RateLimit{Burst: 2, Interval: 10}
+
+	take := func() (bool, bool, time.Duration) {
+		allowed, notify, retryAfter, err := limiter.Take("rate-limit:help:1", limit, clock.now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return allowed, notify, retryAfter
+	}
+
+	tests := []struct {
+		advance    time.Duration
+		allowed    bool
+		notify     bool
+		retryAfter time.Duration
+	}{
+		{0, true, false, 10 * time.Second},
+		{time.Second, true, false, 9 * time.Second},
+		// 制限されたことは一度だけ通知します。
+		{time.Second, false, true, 8 * time.Second},
+		{time.Second, false, false, 7 * time.Second},
+		// 1回分が回復すると実行でき、通知もリセットされます。
+		{7 * time.Second, true, false, 10 * time.Second},
+		{0, false, true, 10 * time.Second},
+		// 容量と間隔の積が過ぎると満杯に戻ります。
+		{20 * time.Second, true, false, 10 * time.Second},
+		{0, true, false, 10 * time.Second},
+	}
+	for i, tt := range tests {
+		clock.advance(tt.advance)
+		allowed, notify, retryAfter := take()
+		if allowed != tt.allowed || notify != tt.notify || retryAfter != tt.retryAfter {
+			t.Errorf("#%d: Take = %v, %v, %s, want %v, %v, %s", i, allowed, notify, retryAfter, tt.allowed, tt.notify, tt.retryAfter)
+		}
+	}
+
+	if allowed, _, _, _ := limiter.Take("rate-limit:help:2", limit, clock.now()); !allowed {
+		t.Error("Take for another user was not allowed")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadPollInterval は設定ファイルと拒否するクライアントの一覧が変更されたかを確認する間隔です。
+const reloadPollInterval = 5 * time.Second
+
+// applyConfig は config のうち、再起動せずに変更できる項目を現在の設定に反映します。
+// 反映した項目と、再起動が必要なため反映しなかった項目の名前を返します。
+func (b *Bot) applyConfig(config Config) (applied, ignored []string) {
+	current := b.Config()
+
+	next := current
+	next.Commands = config.Commands
+	next.RateLimit = config.RateLimit
+	next.TweetBudget = config.TweetBudget
+	next.Profile = config.Profile
+	next.Log = config.Log
+	next.Maintenance = config.Maintenance
+
+	applied = diffConfig(reflect.ValueOf(current), reflect.ValueOf(next), "")
+	ignored = diffConfig(reflect.ValueOf(next), reflect.ValueOf(config), "")
+	if len(applied) == 0 {
+		return applied, ignored
+	}
+
+	b.config.Store(next)
+	if err := configureLogger(next); err != nil {
+		logger.WithError(err).Error("Error while configuring logger")
+	}
+	b.profile.SetTemplates(next)
+	b.profile.Set(ProfileMaintenance, next.Maintenance)
+	return applied, ignored
+}
+
+// diffConfig は a と b で値が異なる項目の、JSONのフィールド名をたどった名前を返します。
+func diffConfig(a, b reflect.Value, path string) []string {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		var changed []string
+		for i := 0; i < a.NumField(); i++ {
+			name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			changed = append(changed, diffConfig(a.Field(i), b.Field(i), join(name))...)
+		}
+		return changed
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, key := range append(a.MapKeys(), b.MapKeys()...) {
+			keys[fmt.Sprint(key.Interface())] = key
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var changed []string
+		for _, name := range names {
+			// A missing key is the same as the zero value.
+			zero := reflect.Zero(a.Type().Elem())
+			va, vb := a.MapIndex(keys[name]), b.MapIndex(keys[name])
+			if !va.IsValid() {
+				va = zero
+			}
+			if !vb.IsValid() {
+				vb = zero
+			}
+			changed = append(changed, diffConfig(va, vb, join(name))...)
+		}
+		return changed
+	default:
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return nil
+		}
+		return []string{path}
+	}
+}
+
+// diffStrings は a になく b にある要素と、a にあり b にない要素を返します。
+func diffStrings(a, b []string) (added, removed []string) {
+	in := func(s string, list []string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range b {
+		if !in(s, a) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !in(s, b) {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// reloader は設定ファイルと拒否するクライアントの一覧を読み込み直し、Botに反映します。
+type reloader struct {
+	bot               *Bot
+	configPath        string
+	deniedClientsPath string
+
+	modTimes map[string]time.Time
+}
+
+func newReloader(bot *Bot, configPath, deniedClientsPath string) *reloader {
+	r := &reloader{
+		bot:               bot,
+		configPath:        configPath,
+		deniedClientsPath: deniedClientsPath,
+		modTimes:          make(map[string]time.Time),
+	}
+	r.changed(configPath)
+	r.changed(deniedClientsPath)
+	return r
+}
+
+// reloadConfig は設定を読み込み直します。誤りがある場合は、現在の設定のまま動作を続けます。
+func (r *reloader) reloadConfig() {
+	entry := logger.WithField("path", r.configPath)
+	config, err := LoadConfig(r.configPath)
+	if err != nil {
+		entry.WithError(err).Error("Could not reload config, keeping the current one")
+		return
+	}
+
+	applied, ignored := r.bot.applyConfig(config)
+	if len(ignored) > 0 {
+		entry.WithField("fields", ignored).Warn("Some config changes require a restart")
+	}
+	if len(applied) > 0 {
+		entry.WithField("changed", applied).Info("Reloaded config")
+	} else {
+		entry.Debug("Config has not changed")
+	}
+}
+
+func (r *reloader) reloadDeniedClients() {
+	if err := r.bot.LoadDeniedClientList(r.deniedClientsPath); err != nil {
+		logger.WithError(err).WithField("path", r.deniedClientsPath).Error("Could not reload denied clients")
+	}
+}
+
+// changed は path の更新時刻が前回の確認から変わったかを返します。
+func (r *reloader) changed(path string) bool {
+	if path == "" {
+		return false
+	}
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	last, ok := r.modTimes[path]
+	r.modTimes[path] = modTime
+	return ok && !modTime.IsZero() && !modTime.Equal(last)
+}
+
+// watch はファイルが更新されたときと、hangup にシグナルが送られたときに読み込み直します。
+// stop が閉じられると戻ります。
+func (r *reloader) watch(stop <-chan struct{}, hangup <-chan os.Signal) {
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case sig := <-hangup:
+			logger.WithFields(logrus.Fields{
+				"signal":         sig.String(),
+				"config":         r.configPath,
+				"denied_clients": r.deniedClientsPath,
+			}).Info("Reloading")
+			r.changed(r.configPath)
+			r.changed(r.deniedClientsPath)
+			r.reloadConfig()
+			r.reloadDeniedClients()
+		case <-ticker.C:
+			if r.changed(r.configPath) {
+				r.reloadConfig()
+			}
+			if r.changed(r.deniedClientsPath) {
+				r.reloadDeniedClients()
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+const (
+	replayConsumerSecret = "replay-consumer-secret"
+	replayWebhookPath    = "/webhook"
+	replayTimeout        = 3 * time.Second
+)
+
+// replayBotUser はリプレイ中にBotとしてログインしているアカウントです。
+// フィクスチャの for_user_id やメンションはこのアカウントに合わせてください。
+var replayBotUser = twitter.User{
+	ID:         1000,
+	IDStr:      "1000",
+	Name:       "tomobotter",
+	ScreenName: "tomobotter",
+}
+
+// replayExpectation はフィクスチャの expect.json の内容です。
+type replayExpectation struct {
+	// Tweets はフェイクのクライアントから検索できるツイートです。
+	Tweets []twitter.Tweet `json:"tweets"`
+	// ProtectedTweets は非公開アカウントのツイートとして扱うIDです。
+	ProtectedTweets []int64 `json:"protected_tweets"`
+	// Now はBotの現在の時刻です。空の場合は実際の時刻を使います。
+	Now *time.Time `json:"now"`
+	// State は再生する前に保存されている状態です。
+	State map[string]string `json:"state"`
+	// Downloads は再生する前に保存されているダウンロードです。
+	Downloads []struct {
+		ScreenName string `json:"screen_name"`
+		TweetID    int64  `json:"tweet_id"`
+	} `json:"downloads"`
+
+	Statuses []struct {
+		Text              string `json:"text"`
+		InReplyToStatusID int64  `json:"in_reply_to_status_id"`
+	} `json:"statuses"`
+	DirectMessages []struct {
+		RecipientID string `json:"recipient_id"`
+		Text        string `json:"text"`
+	} `json:"direct_messages"`
+}
+
+// TestReplay は testdata/replay 以下のフィクスチャをすべて再生し、期待した返信が送信されたかを確かめます。
+// フィクスチャは一つのディレクトリにつき、記録されたAccount Activityのペイロード payload.json と
+// 期待する返信 expect.json を置きます。
+func TestReplay(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	cases, err := filepath.Glob(filepath.Join("testdata", "replay", "*", "payload.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no fixtures found in testdata/replay")
+	}
+
+	for _, payloadPath := range cases {
+		dir := filepath.Dir(payloadPath)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			if err := replayFixture(dir); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func replayFixture(dir string) error {
+	payload, err := ioutil.ReadFile(filepath.Join(dir, "payload.json"))
+	if err != nil {
+		return err
+	}
+
+	var expect replayExpectation
+	if file, err := ioutil.ReadFile(filepath.Join(dir, "expect.json")); err == nil {
+		if err := json.Unmarshal(file, &expect); err != nil {
+			return fmt.Errorf("invalid expect.json: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	fake := NewFakeTwitterClient(replayBotUser)
+	for _, tweet := range expect.Tweets {
+		fake.AddTweet(tweet)
+	}
+	for _, id := range expect.ProtectedTweets {
+		fake.AddProtectedTweet(id)
+	}
+
+	var config Config
+	config.Path.Webhook = replayWebhookPath
+	config.Twitter.ConsumerSecret = replayConsumerSecret
+	config.Database.Driver = "sqlite"
+	config.SQLite.Path = ":memory:"
+
+	downloads, err := replayDownloadStore(config)
+	if err != nil {
+		return err
+	}
+	for _, d := range expect.Downloads {
+		if err := downloads.Insert(Download{ScreenName: d.ScreenName, TweetID: d.TweetID}); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now
+	if expect.Now != nil {
+		fixed := *expect.Now
+		now = func() time.Time { return fixed }
+	}
+	state := NewMemoryStateStore(now)
+	for key, value := range expect.State {
+		if err := state.Set(key, value, 0); err != nil {
+			return err
+		}
+	}
+
+	bot, err := NewBot(config, Dependencies{Twitter: fake, Downloads: downloads, State: state, Now: now})
+	if err != nil {
+		return err
+	}
+	defer bot.Close()
+	bot.Start()
+	router := bot.NewRouter()
+
+	if err := replayCRC(router); err != nil {
+		return err
+	}
+
+	req := httptest.NewRequest(http.MethodPost, replayWebhookPath, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Twitter-Webhooks-Signature", webhookSignature(payload, replayConsumerSecret))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("webhook responded with %d: %s", rec.Code, rec.Body.String())
+	}
+
+	statuses, messages := waitForReplies(fake, len(expect.Statuses), len(expect.DirectMessages))
+
+	var problems []string
+	if len(statuses) != len(expect.Statuses) {
+		problems = append(problems, fmt.Sprintf("expected %d tweet(s), got %d: %q", len(expect.Statuses), len(statuses), statusTexts(statuses)))
+	} else {
+		for i, want := range expect.Statuses {
+			got := statuses[i]
+			if got.Text != want.Text || got.InReplyToStatusID != want.InReplyToStatusID {
+				problems = append(problems, fmt.Sprintf("tweet #%d: expected %q in reply to %d, got %q in reply to %d", i, want.Text, want.InReplyToStatusID, got.Text, got.InReplyToStatusID))
+			}
+		}
+	}
+	if len(messages) != len(expect.DirectMessages) {
+		problems = append(problems, fmt.Sprintf("expected %d direct message(s), got %d: %q", len(expect.DirectMessages), len(messages), messageTexts(messages)))
+	} else {
+		for i, want := range expect.DirectMessages {
+			got := messages[i].Message
+			if got.Data.Text != want.Text || got.Target.RecipientID != want.RecipientID {
+				problems = append(problems, fmt.Sprintf("direct message #%d: expected %q to %s, got %q to %s", i, want.Text, want.RecipientID, got.Data.Text, got.Target.RecipientID))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// replayDownloadStore はフィクスチャごとに空のデータベースを作成します。
+func replayDownloadStore(config Config) (DownloadStore, error) {
+	db, driver, err := openDB(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := MigrateUp(db, driver); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newDownloadStore(driver, db)
+}
+
+// replayCRC はWebhookの登録時に送られてくるCRCのリクエストに正しく応答できるかを確かめます。
+func replayCRC(router *gin.Engine) error {
+	req := httptest.NewRequest(http.MethodGet, replayWebhookPath+"?crc_token=replay", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	var res struct {
+		ResponseToken string `json:"response_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		return fmt.Errorf("invalid crc response: %s", err)
+	}
+	if res.ResponseToken != webhookSignature([]byte("replay"), replayConsumerSecret) {
+		return fmt.Errorf("unexpected crc response token: %s", res.ResponseToken)
+	}
+	return nil
+}
+
+// waitForReplies は期待した数の返信が送信されるか、タイムアウトするまで待ちます。
+// 期待した数に達した後も、余分な返信がないか少しだけ待ちます。
+func waitForReplies(fake *FakeTwitterClient, statuses, messages int) ([]twitter.Tweet, []twitter.DirectMessageEvent) {
+	deadline := time.Now().Add(replayTimeout)
+	for time.Now().Before(deadline) {
+		if len(fake.SentStatuses()) >= statuses && len(fake.SentDirectMessages()) >= messages {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return fake.SentStatuses(), fake.SentDirectMessages()
+}
+
+func statusTexts(tweets []twitter.Tweet) []string {
+	texts := make([]string, len(tweets))
+	for i, tweet := range tweets {
+		texts[i] = tweet.Text
+	}
+	return texts
+}
+
+func messageTexts(events []twitter.DirectMessageEvent) []string {
+	texts := make([]string, len(events))
+	for i, event := range events {
+		texts[i] = event.Message.Data.Text
+	}
+	return texts
+}
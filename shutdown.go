@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout は終了するときに実行中のコマンドとキューの処理を待つ最大の時間です。
+const defaultShutdownTimeout = 30 * time.Second
+
+func (c Config) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout > 0 {
+		return time.Duration(c.ShutdownTimeout) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// dispatchAsync はコマンドを別のゴルーチンで実行します。実行中のコマンドは Shutdown で待たれます。
+func (b *Bot) dispatchAsync(s CommandSender, c string) {
+	b.commandsRunning.Add(1)
+	go func() {
+		defer b.commandsRunning.Done()
+		b.Dispatch(s, c)
+	}()
+}
+
+// Shutdown はWebhookのイベントの受け付けを止め、実行中のコマンドが終わるのを待ってから、
+// 検索キューと送信キューを止めます。送信キューはすぐに送信できるメッセージを送信し終えてから止まります。
+// ctx が終了するまでに終わらなかった場合は ctx.Err() を返します。
+// HTTPサーバーは先に止めてください。
+func (b *Bot) Shutdown(ctx context.Context) error {
+	close(b.stopListening)
+	if b.listenDone != nil {
+		select {
+		case <-b.listenDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Commands may still be waiting for lookups and enqueueing replies.
+	if err := waitGroupContext(ctx, &b.commandsRunning); err != nil {
+		return err
+	}
+	logger.Info("All commands finished")
+
+	close(b.quit)
+	if err := waitGroupContext(ctx, &b.workers); err != nil {
+		return err
+	}
+
+	if n, err := b.outbound.Len(); err == nil && n > 0 {
+		logger.WithField("count", n).Warn("Messages are left in the outbound queue")
+	}
+	return nil
+}
+
+// waitGroupContext は wg を待ちます。ctx が先に終了した場合は ctx.Err() を返します。
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
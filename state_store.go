@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// StateDriverRedis と StateDriverMemory は設定の state.driver の値です。
+	StateDriverRedis  = "redis"
+	StateDriverMemory = "memory"
+)
+
+// memorySweepInterval はメモリ上に保存したものから期限の切れたものを削除する間隔です。
+// 削除は書き込むときに行うため、読み込まれないキーも溜まり続けることはありません。
+const memorySweepInterval = time.Minute
+
+// ErrStateNotFound はキーが存在しないか、期限が切れている場合のエラーです。
+var ErrStateNotFound = errors.New("state not found")
+
+// StateStore はBotの状態を保存するキーバリューストアです。
+// ソート済みセットやスクリプトを使う送信キューなどは、これを使わずにRedisを直接使います。
+// それらもRedisを使わない場合はメモリ上の実装に切り替わります。
+type StateStore interface {
+	// Get はキーの値を返します。キーがない場合は ErrStateNotFound を返します。
+	Get(key string) (string, error)
+	// Set は値を保存します。ttl が0の場合は期限なしで保存します。
+	Set(key, value string, ttl time.Duration) error
+	// SetNX はキーがない場合だけ値を保存し、保存したかを返します。
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	Del(keys ...string) error
+	// Incr はキーの整数値に1を足した値を保存して返します。キーがない場合は0として扱います。期限は変わりません。
+	Incr(key string) (int64, error)
+}
+
+type redisStateStore struct {
+	redis *redis.Client
+}
+
+// NewRedisStateStore はRedisに保存する StateStore を作成します。
+func NewRedisStateStore(redisClient *redis.Client) StateStore {
+	return &redisStateStore{redis: redisClient}
+}
+
+func (s *redisStateStore) Get(key string) (string, error) {
+	value, err := s.redis.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrStateNotFound
+	}
+	return value, err
+}
+
+func (s *redisStateStore) Set(key, value string, ttl time.Duration) error {
+	return s.redis.Set(key, value, ttl).Err()
+}
+
+func (s *redisStateStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return s.redis.SetNX(key, value, ttl).Result()
+}
+
+func (s *redisStateStore) Del(keys ...string) error {
+	return s.redis.Del(keys...).Err()
+}
+
+func (s *redisStateStore) Incr(key string) (int64, error) {
+	return s.redis.Incr(key).Result()
+}
+
+// memoryStateStore はメモリ上に保存する StateStore です。
+// Redisを使わずにBotを動かす場合に利用します。再起動すると状態は失われます。
+type memoryStateStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]stateEntry
+	lastSweep time.Time
+}
+
+type stateEntry struct {
+	value string
+	// expiresAt がゼロの場合は期限がありません。
+	expiresAt time.Time
+}
+
+// NewMemoryStateStore はメモリ上に保存する StateStore を作成します。期限は now で判断します。
+func NewMemoryStateStore(now func() time.Time) StateStore {
+	return &memoryStateStore{now: now, entries: make(map[string]stateEntry)}
+}
+
+// get は期限の切れていない値を返します。s.mu をロックしてから呼んでください。
+func (s *memoryStateStore) get(key string) (stateEntry, bool) {
+	entry, ok := s.entries[key]
+	if ok && !entry.expiresAt.IsZero() && !s.now().Before(entry.expiresAt) {
+		delete(s.entries, key)
+		return stateEntry{}, false
+	}
+	return entry, ok
+}
+
+// sweep は memorySweepInterval ごとに期限の切れた値を削除します。s.mu をロックしてから呼んでください。
+func (s *memoryStateStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	for key, entry := range s.entries {
+		if !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func (s *memoryStateStore) set(key, value string, ttl time.Duration) {
+	s.sweep()
+	entry := stateEntry{value: value}
+	if ttl > 0 {
+		entry.expiresAt = s.now().Add(ttl)
+	}
+	s.entries[key] = entry
+}
+
+func (s *memoryStateStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.get(key)
+	if !ok {
+		return "", ErrStateNotFound
+	}
+	return entry.value, nil
+}
+
+func (s *memoryStateStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, ttl)
+	return nil
+}
+
+func (s *memoryStateStore) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+	return true, nil
+}
+
+func (s *memoryStateStore) Del(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryStateStore) Incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, _ := s.get(key)
+	var n int64
+	if entry.value != "" {
+		var err error
+		if n, err = strconv.ParseInt(entry.value, 10, 64); err != nil {
+			return 0, errors.New("value is not an integer")
+		}
+	}
+	n++
+	entry.value = strconv.FormatInt(n, 10)
+	s.sweep()
+	s.entries[key] = entry
+	return n, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStoreTTL(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStateStore(clock.now)
+	if err := store.Set("expiring", "a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("permanent", "b", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(time.Minute - time.Second)
+	if value, err := store.Get("expiring"); err != nil || value != "a" {
+		t.Errorf("Get before expiry = %q, %v, want %q", value, err, "a")
+	}
+
+	clock.advance(time.Second)
+	if _, err := store.Get("expiring"); err != ErrStateNotFound {
+		t.Errorf("Get after expiry: err = %v, want ErrStateNotFound", err)
+	}
+	clock.advance(365 * 24 * time.Hour)
+	if value, err := store.Get("permanent"); err != nil || value != "b" {
+		t.Errorf("Get without ttl = %q, %v, want %q", value, err, "b")
+	}
+
+	if err := store.Del("permanent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("permanent"); err != ErrStateNotFound {
+		t.Errorf("Get after Del: err = %v, want ErrStateNotFound", err)
+	}
+}
+
+func TestMemoryStateStoreSetNX(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStateStore(clock.now)
+
+	if ok, err := store.SetNX("lock", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("SetNX on a new key = %v, %v, want true", ok, err)
+	}
+	if ok, err := store.SetNX("lock", "b", time.Minute); err != nil || ok {
+		t.Errorf("SetNX on an existing key = %v, %v, want false", ok, err)
+	}
+	if value, _ := store.Get("lock"); value != "a" {
+		t.Errorf("Get = %q, want the first value %q", value, "a")
+	}
+
+	clock.advance(time.Minute)
+	if ok, err := store.SetNX("lock", "c", time.Minute); err != nil || !ok {
+		t.Errorf("SetNX on an expired key = %v, %v, want true", ok, err)
+	}
+}
+
+func TestMemoryStateStoreIncr(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStateStore(clock.now)
+
+	for want := int64(1); want <= 3; want++ {
+		if n, err := store.Incr("counter"); err != nil || n != want {
+			t.Errorf("Incr = %d, %v, want %d", n, err, want)
+		}
+	}
+
+	// Incr は期限を変えません。
+	if err := store.Set("daily", "5", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(30 * time.Minute)
+	if n, err := store.Incr("daily"); err != nil || n != 6 {
+		t.Errorf("Incr = %d, %v, want 6", n, err)
+	}
+	clock.advance(30 * time.Minute)
+	if n, err := store.Incr("daily"); err != nil || n != 1 {
+		t.Errorf("Incr after expiry = %d, %v, want 1", n, err)
+	}
+
+	if err := store.Set("text", "a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Incr("text"); err == nil {
+		t.Error("Incr on a non-integer value: err = nil")
+	}
+}
+
+func TestMemoryStateStoreSweep(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStateStore(clock.now).(*memoryStateStore)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set(key, "1", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set("permanent", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 読み込まれないまま期限が切れたものは、次の書き込みで削除されます。
+	clock.advance(memorySweepInterval)
+	if err := store.Set("d", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.entries); n != 2 {
+		t.Errorf("entries after sweep = %d, want 2", n)
+	}
+}
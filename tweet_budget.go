@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Redis Key
+	TweetBudgetKey = "tweet-budget"
+
+	// tweetBudgetWindow はツイートの制限が数えられる期間です。
+	tweetBudgetWindow = 24 * time.Hour
+	// defaultDailyTweetLimit はTwitterの1日のツイートの上限です。
+	// https://help.twitter.com/en/rules-and-policies/twitter-limits
+	defaultDailyTweetLimit = 2400
+)
+
+// TweetBudget は直近24時間に送信したツイートの数と、残りの数です。
+type TweetBudget struct {
+	Limit     int
+	Used      int
+	Remaining int
+	// ResetAt は次に1ツイート分の枠が空く時間です。一度もツイートしていない場合はゼロです。
+	ResetAt time.Time
+}
+
+func (c Config) dailyTweetLimit() int {
+	if c.TweetBudget.DailyLimit > 0 {
+		return c.TweetBudget.DailyLimit
+	}
+	return defaultDailyTweetLimit
+}
+
+// tweetLog は送信したツイートを記録し、直近 tweetBudgetWindow の間に送信した数を数えます。
+type tweetLog interface {
+	// Record は id のツイートを at に送信したことを記録します。
+	Record(id string, at time.Time) error
+	// Count は now までの tweetBudgetWindow の間に送信したツイートの数と、そのうち最も古いものの時刻を返します。
+	// それより古い記録は削除されます。
+	Count(now time.Time) (int, time.Time, error)
+}
+
+// redisTweetLog はRedisのソート済みセットに、送信した時刻をスコアとして記録します。
+type redisTweetLog struct {
+	redis *redis.Client
+}
+
+func newRedisTweetLog(redisClient *redis.Client) tweetLog {
+	return &redisTweetLog{redis: redisClient}
+}
+
+func (l *redisTweetLog) Record(id string, at time.Time) error {
+	_, err := l.redis.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(TweetBudgetKey, redis.Z{Score: float64(unixMillis(at)), Member: id})
+		pipe.Expire(TweetBudgetKey, tweetBudgetWindow)
+		return nil
+	})
+	return err
+}
+
+func (l *redisTweetLog) Count(now time.Time) (int, time.Time, error) {
+	min := strconv.FormatInt(unixMillis(now.Add(-tweetBudgetWindow)), 10)
+
+	var count *redis.IntCmd
+	var oldest *redis.ZSliceCmd
+	_, err := l.redis.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(TweetBudgetKey, "-inf", "("+min)
+		count = pipe.ZCard(TweetBudgetKey)
+		oldest = pipe.ZRangeWithScores(TweetBudgetKey, 0, 0)
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var oldestAt time.Time
+	if z := oldest.Val(); len(z) > 0 {
+		oldestAt = time.Unix(0, int64(z[0].Score)*int64(time.Millisecond))
+	}
+	return int(count.Val()), oldestAt, nil
+}
+
+// memoryTweetLog はメモリ上に送信した時刻を記録します。再起動すると記録は失われます。
+type memoryTweetLog struct {
+	mu sync.Mutex
+	// sent は送信した時刻を古い順に並べたものです。
+	sent []time.Time
+}
+
+func newMemoryTweetLog() tweetLog {
+	return &memoryTweetLog{}
+}
+
+func (l *memoryTweetLog) Record(_ string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.sent), func(i int) bool {
+		return l.sent[i].After(at)
+	})
+	l.sent = append(l.sent, time.Time{})
+	copy(l.sent[i+1:], l.sent[i:])
+	l.sent[i] = at
+	return nil
+}
+
+func (l *memoryTweetLog) Count(now time.Time) (int, time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	min := now.Add(-tweetBudgetWindow)
+	i := sort.Search(len(l.sent), func(i int) bool {
+		return !l.sent[i].Before(min)
+	})
+	l.sent = l.sent[i:]
+	if len(l.sent) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return len(l.sent), l.sent[0], nil
+}
+
+// TweetBudget は記録されたツイートから、直近24時間のツイートの残りの数を返します。
+func (b *Bot) TweetBudget() (TweetBudget, error) {
+	limit := b.Config().dailyTweetLimit()
+	budget := TweetBudget{Limit: limit, Remaining: limit}
+
+	used, oldest, err := b.tweets.Count(b.now())
+	if err != nil {
+		return budget, err
+	}
+
+	budget.Used = used
+	budget.Remaining = limit - budget.Used
+	if budget.Remaining < 0 {
+		budget.Remaining = 0
+	}
+	if !oldest.IsZero() {
+		budget.ResetAt = oldest.Add(tweetBudgetWindow)
+	}
+	return budget, nil
+}
+
+// recordTweet は送信したツイートを直近24時間のツイートとして記録します。
+func (b *Bot) recordTweet(id string, at time.Time) error {
+	return b.tweets.Record(id, at)
+}
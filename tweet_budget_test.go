@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTweetLog(t *testing.T) {
+	drivers := []struct {
+		name string
+		new  func(t *testing.T) tweetLog
+	}{
+		{"memory", func(*testing.T) tweetLog { return newMemoryTweetLog() }},
+		{"redis", func(t *testing.T) tweetLog { return newRedisTweetLog(newTestRedis(t)) }},
+	}
+	for _, driver := range drivers {
+		t.Run(driver.name, func(t *testing.T) {
+			testTweetLog(t, driver.new(t))
+		})
+	}
+}
+
+func testTweetLog(t *testing.T, log tweetLog) {
+	clock := newTestClock()
+	start := clock.now()
+	// 送信した順に記録されるとは限りません。
+	for i, at := range []time.Time{start.Add(2 * time.Hour), start, start.Add(time.Hour)} {
+		if err := log.Record(strconv.Itoa(i), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		now    time.Time
+		count  int
+		oldest time.Time
+	}{
+		{start.Add(2 * time.Hour), 3, start},
+		// ちょうど24時間前のツイートはまだ数えます。
+		{start.Add(tweetBudgetWindow), 3, start},
+		{start.Add(tweetBudgetWindow + time.Millisecond), 2, start.Add(time.Hour)},
+		{start.Add(tweetBudgetWindow + 2*time.Hour), 1, start.Add(2 * time.Hour)},
+		{start.Add(tweetBudgetWindow + 3*time.Hour), 0, time.Time{}},
+	}
+	for _, tt := range tests {
+		count, oldest, err := log.Count(tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.count || !oldest.Equal(tt.oldest) {
+			t.Errorf("Count(%s) = %d, %s, want %d, %s", tt.now, count, oldest, tt.count, tt.oldest)
+		}
+	}
+}
+
+func TestBotTweetBudget(t *testing.T) {
+	clock := newTestClock()
+	var config Config
+	config.TweetBudget.DailyLimit = 2
+	bot := newTestBot(t, config, NewFakeTwitterClient(replayBotUser), clock)
+
+	if budget, err := bot.TweetBudget(); err != nil || budget != (TweetBudget{Limit: 2, Remaining: 2}) {
+		t.Errorf("TweetBudget without tweets = %+v, %v", budget, err)
+	}
+
+	start := clock.now()
+	for i := 0; i < 3; i++ {
+		if err := bot.recordTweet(strconv.Itoa(i), clock.now()); err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Hour)
+	}
+	budget, err := bot.TweetBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Used != 3 || budget.Remaining != 0 || !budget.ResetAt.Equal(start.Add(tweetBudgetWindow)) {
+		t.Errorf("TweetBudget over the limit = %+v", budget)
+	}
+}
+
+func TestSendOutboundBudget(t *testing.T) {
+	reply := newMessage("@alice reply", 100, PriorityReply)
+	fallback := reply
+	fallback.RecipientID = 10
+	fallback.Body = "reply"
+	notice := newMessage("@alice notice", 100, PriorityNotice)
+	broadcast := newMessage("broadcast", 0, PriorityBroadcast)
+
+	const (
+		sent = iota
+		sentDirectMessage
+		retried
+		dead
+	)
+	tests := []struct {
+		name        string
+		used        int
+		statusError int
+		message     Message
+		want        int
+		// retryAfter は戻されたメッセージが再び送信されるまでの時間です。
+		retryAfter time.Duration
+		blocked    bool
+	}{
+		{name: "reply", message: reply, want: sent},
+		{name: "notice", used: 4, message: notice, want: sent},
+		{name: "notice within reserve", used: 5, message: notice, want: dead},
+		{name: "broadcast", used: 6, message: broadcast, want: sent},
+		{name: "broadcast within reserve", used: 7, message: broadcast, want: retried, retryAfter: 23 * time.Hour},
+		{name: "reply within fallback reserve", used: 8, message: fallback, want: sentDirectMessage},
+		{name: "reply without recipient", used: 8, message: reply, want: sent},
+		{name: "reply over limit", used: 10, message: reply, want: retried, retryAfter: 23 * time.Hour, blocked: true},
+		{name: "notice over limit", used: 10, message: notice, want: dead, blocked: true},
+		// 記録に無いツイートで制限された場合は、しばらく待ってから再び送信します。
+		{name: "reply rejected by limit", statusError: 185, message: reply, want: retried, retryAfter: 10 * time.Minute, blocked: true},
+		{name: "notice rejected by limit", statusError: 185, message: notice, want: dead, blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newTestClock()
+			var config Config
+			config.TweetBudget.DailyLimit = 10
+			config.TweetBudget.NoticeReserve = 5
+			config.TweetBudget.BroadcastReserve = 3
+			config.TweetBudget.DMFallbackReserve = 2
+			fake := NewFakeTwitterClient(replayBotUser)
+			fake.SetStatusErrorCode(tt.statusError)
+			bot := newTestBot(t, config, fake, clock)
+
+			for i := 0; i < tt.used; i++ {
+				if err := bot.recordTweet(strconv.Itoa(i), clock.now().Add(-time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := bot.outbound.Enqueue(tt.message, clock.now()); err != nil {
+				t.Fatal(err)
+			}
+			message, ok, err := bot.outbound.Next(clock.now())
+			if err != nil || !ok {
+				t.Fatalf("Next = %v, %v, want the message", ok, err)
+			}
+			if err := bot.sendOutbound(message); err != nil {
+				t.Fatal(err)
+			}
+
+			statuses, directMessages := fake.SentStatuses(), fake.SentDirectMessages()
+			if got := len(statuses) == 1; got != (tt.want == sent) {
+				t.Errorf("sent statuses = %d", len(statuses))
+			}
+			if got := len(directMessages) == 1; got != (tt.want == sentDirectMessage) {
+				t.Errorf("sent direct messages = %d", len(directMessages))
+			} else if got && (directMessages[0].Message.Target.RecipientID != "10" || directMessages[0].Message.Data.Text != "reply") {
+				t.Errorf("direct message = %+v, want the body to the recipient", directMessages[0].Message)
+			}
+			if budget, _ := bot.TweetBudget(); tt.want == sent && budget.Used != tt.used+1 {
+				t.Errorf("TweetBudget.Used = %d, want the sent tweet recorded", budget.Used)
+			}
+
+			q := bot.outbound.(*memoryOutboundQueue)
+			if got := len(q.dead) == 1; got != (tt.want == dead) {
+				t.Errorf("dead letters = %d", len(q.dead))
+			}
+			n, _ := q.Len()
+			if got := n == 1; got != (tt.want == retried) {
+				t.Errorf("Len = %d", n)
+			}
+			if tt.want == retried {
+				if _, ok, _ := q.Next(clock.now().Add(tt.retryAfter - time.Second)); ok {
+					t.Errorf("retried message was due before %s", tt.retryAfter)
+				}
+				if _, ok, _ := q.Next(clock.now().Add(tt.retryAfter)); !ok {
+					t.Errorf("retried message was not due after %s", tt.retryAfter)
+				}
+			}
+
+			until := bot.noReplyUntil()
+			if until.IsZero() == tt.blocked {
+				t.Errorf("noReplyUntil = %s, want blocked %v", until, tt.blocked)
+			} else if tt.blocked && tt.want == retried && !until.Equal(clock.now().Add(tt.retryAfter)) {
+				t.Errorf("noReplyUntil = %s, want %s", until, clock.now().Add(tt.retryAfter))
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/go-redis/redis"
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+const (
+	// Redis Key prefix, tweet:<tweet id>
+	TweetCachePrefix = "tweet:"
+
+	defaultTweetCacheSize        = 1000
+	defaultTweetCacheTTL         = 1 * time.Hour
+	defaultTweetCacheNegativeTTL = 5 * time.Minute
+)
+
+// cachedTweet はキャッシュされたツイートか、ツイートが見つからなかったことを表します。
+type cachedTweet struct {
+	Tweet *twitter.Tweet `json:"tweet,omitempty"`
+	// Error は "not_found" か "protected" です。
+	Error string `json:"error,omitempty"`
+
+	id      int64
+	expires time.Time
+}
+
+func (c *cachedTweet) result() lookupResult {
+	switch c.Error {
+	case "not_found":
+		return lookupResult{err: ErrTweetNotFound}
+	case "protected":
+		return lookupResult{err: ErrTweetProtected}
+	}
+	return lookupResult{tweet: *c.Tweet}
+}
+
+// tweetCache は検索したツイートをメモリ上のLRUとRedisにキャッシュします。
+// 削除されたツイートや非公開のツイートも、短い期間だけキャッシュします。
+type tweetCache struct {
+	redis       *redis.Client
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[int64]*list.Element
+}
+
+func newTweetCache(config Config, redisClient *redis.Client) *tweetCache {
+	c := &tweetCache{
+		redis:       redisClient,
+		size:        config.TweetCache.Size,
+		ttl:         time.Duration(config.TweetCache.TTL) * time.Second,
+		negativeTTL: time.Duration(config.TweetCache.NegativeTTL) * time.Second,
+		lru:         list.New(),
+		entries:     make(map[int64]*list.Element),
+	}
+	if c.size <= 0 {
+		c.size = defaultTweetCacheSize
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultTweetCacheTTL
+	}
+	if c.negativeTTL <= 0 {
+		c.negativeTTL = defaultTweetCacheNegativeTTL
+	}
+	return c
+}
+
+// Get はキャッシュされた検索の結果を返します。キャッシュにない場合は false を返します。
+// 見つからなかったことがキャッシュされている場合の結果は ErrTweetNotFound か ErrTweetProtected になります。
+func (c *tweetCache) Get(id int64) (lookupResult, bool) {
+	if entry := c.getMemory(id); entry != nil {
+		tweetCacheRequests.WithLabelValues("memory_hit").Inc()
+		return entry.result(), true
+	}
+
+	if c.redis != nil {
+		raw, err := c.redis.Get(TweetCachePrefix + strconv.FormatInt(id, 10)).Bytes()
+		if err == nil {
+			var entry cachedTweet
+			if err := json.Unmarshal(raw, &entry); err == nil && (entry.Tweet != nil || entry.Error != "") {
+				tweetCacheRequests.WithLabelValues("redis_hit").Inc()
+				ttl := c.ttl
+				if entry.Error != "" {
+					ttl = c.negativeTTL
+				}
+				c.setMemory(id, entry, ttl)
+				return entry.result(), true
+			}
+		} else if err != redis.Nil {
+			sentry.CaptureException(err)
+		}
+	}
+
+	tweetCacheRequests.WithLabelValues("miss").Inc()
+	return lookupResult{}, false
+}
+
+// Set はツイートをキャッシュします。
+func (c *tweetCache) Set(tweet twitter.Tweet) {
+	c.set(tweet.ID, cachedTweet{Tweet: &tweet}, c.ttl)
+}
+
+// SetError はツイートが見つからなかったことをキャッシュします。
+// ErrTweetNotFound と ErrTweetProtected 以外のエラーはキャッシュしません。
+func (c *tweetCache) SetError(id int64, err error) {
+	switch err {
+	case ErrTweetNotFound:
+		c.set(id, cachedTweet{Error: "not_found"}, c.negativeTTL)
+	case ErrTweetProtected:
+		c.set(id, cachedTweet{Error: "protected"}, c.negativeTTL)
+	}
+}
+
+func (c *tweetCache) set(id int64, entry cachedTweet, ttl time.Duration) {
+	c.setMemory(id, entry, ttl)
+	if c.redis == nil {
+		return
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		sentry.CaptureException(err)
+		return
+	}
+	if err := c.redis.Set(TweetCachePrefix+strconv.FormatInt(id, 10), raw, ttl).Err(); err != nil {
+		sentry.CaptureException(err)
+	}
+}
+
+func (c *tweetCache) getMemory(id int64) *cachedTweet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cachedTweet)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, id)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return entry
+}
+
+func (c *tweetCache) setMemory(id int64, entry cachedTweet, ttl time.Duration) {
+	entry.id = id
+	entry.expires = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		e.Value = &entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[id] = c.lru.PushFront(&entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedTweet).id)
+	}
+}
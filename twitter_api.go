@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// TwitterAPI はBotが利用するTwitter APIの操作をまとめたインターフェースです。
+// 本番では twitterClient を、ローカルやテストでは FakeTwitterClient を利用します。
+type TwitterAPI interface {
+	// VerifyCredentials はログインしているユーザーを返します。
+	VerifyCredentials() (*twitter.User, *http.Response, error)
+
+	// LookupTweets は statuses/lookup を呼び、見つかったツイートのみを返します。
+	LookupTweets(ids []int64, params *twitter.StatusLookupParams) ([]twitter.Tweet, *http.Response, error)
+
+	// ShowTweet は statuses/show/:id を呼びます。
+	ShowTweet(id int64, params *twitter.StatusShowParams) (*twitter.Tweet, *http.Response, error)
+
+	// UpdateStatus はツイートを送信します。
+	UpdateStatus(status string, params *twitter.StatusUpdateParams) (*twitter.Tweet, *http.Response, error)
+
+	// SendDirectMessage はダイレクトメッセージを送信します。
+	SendDirectMessage(params *twitter.DirectMessageEventsNewParams) (*twitter.DirectMessageEvent, *http.Response, error)
+
+	// UpdateProfile はBotのプロフィールを更新します。
+	UpdateProfile(params *twitter.AccountProfileParams) (*twitter.User, *http.Response, error)
+}
+
+// twitterClient は go-twitter のクライアントを TwitterAPI として扱うためのラッパーです。
+type twitterClient struct {
+	client *twitter.Client
+}
+
+func NewTwitterClient(httpClient *http.Client) TwitterAPI {
+	return &twitterClient{client: twitter.NewClient(httpClient)}
+}
+
+func (c *twitterClient) VerifyCredentials() (*twitter.User, *http.Response, error) {
+	return c.client.Accounts.VerifyCredentials(nil)
+}
+
+func (c *twitterClient) LookupTweets(ids []int64, params *twitter.StatusLookupParams) ([]twitter.Tweet, *http.Response, error) {
+	return c.client.Statuses.Lookup(ids, params)
+}
+
+func (c *twitterClient) ShowTweet(id int64, params *twitter.StatusShowParams) (*twitter.Tweet, *http.Response, error) {
+	return c.client.Statuses.Show(id, params)
+}
+
+func (c *twitterClient) UpdateStatus(status string, params *twitter.StatusUpdateParams) (*twitter.Tweet, *http.Response, error) {
+	return c.client.Statuses.Update(status, params)
+}
+
+func (c *twitterClient) SendDirectMessage(params *twitter.DirectMessageEventsNewParams) (*twitter.DirectMessageEvent, *http.Response, error) {
+	return c.client.DirectMessages.EventsNew(params)
+}
+
+func (c *twitterClient) UpdateProfile(params *twitter.AccountProfileParams) (*twitter.User, *http.Response, error) {
+	return c.client.Accounts.UpdateProfile(params)
+}
+
+// apiErrorCode はTwitter APIのエラーコードを返します。APIエラーでなかった場合は0を返します。
+func apiErrorCode(err error) int {
+	if apiErr, ok := err.(twitter.APIError); ok && len(apiErr.Errors) > 0 {
+		return apiErr.Errors[0].Code
+	}
+	return 0
+}
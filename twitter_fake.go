@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tomocrafter/go-twitter/twitter"
+)
+
+// FakeTwitterClient はメモリ上で動作する TwitterAPI の実装です。
+// ツイート、ダイレクトメッセージ、プロフィールの変更をすべて記録するため、
+// 認証情報なしでコマンドの動作を確認することができます。
+type FakeTwitterClient struct {
+	mu sync.Mutex
+
+	User      twitter.User
+	tweets    map[int64]twitter.Tweet
+	protected map[int64]bool
+	nextID    int64
+
+	statuses       []twitter.Tweet
+	directMessages []twitter.DirectMessageEvent
+	profiles       []twitter.AccountProfileParams
+
+	statusErrorCode int
+	lookupErrorCode int
+
+	directMessageDelay time.Duration
+
+	lookupCalls int
+	showCalls   int
+}
+
+func NewFakeTwitterClient(user twitter.User) *FakeTwitterClient {
+	return &FakeTwitterClient{
+		User:      user,
+		tweets:    make(map[int64]twitter.Tweet),
+		protected: make(map[int64]bool),
+		nextID:    1,
+	}
+}
+
+// AddTweet は検索可能なツイートを追加します。
+func (c *FakeTwitterClient) AddTweet(tweet twitter.Tweet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tweets[tweet.ID] = tweet
+}
+
+// AddProtectedTweet は非公開アカウントのツイートとして扱うIDを追加します。
+func (c *FakeTwitterClient) AddProtectedTweet(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protected[id] = true
+}
+
+// SetStatusErrorCode を設定すると、UpdateStatus はそのコードのエラーを返すようになります。
+// 0を設定すると通常通りツイートを記録します。
+func (c *FakeTwitterClient) SetStatusErrorCode(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statusErrorCode = code
+}
+
+// SetLookupErrorCode を設定すると、LookupTweets はそのコードのエラーを返すようになります。
+// 0を設定すると通常通りツイートを検索します。
+func (c *FakeTwitterClient) SetLookupErrorCode(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lookupErrorCode = code
+}
+
+// SetDirectMessageDelay を設定すると、SendDirectMessage は d だけ待ってから送信します。
+func (c *FakeTwitterClient) SetDirectMessageDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.directMessageDelay = d
+}
+
+// SentStatuses は送信されたツイートのコピーを返します。
+func (c *FakeTwitterClient) SentStatuses() []twitter.Tweet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]twitter.Tweet(nil), c.statuses...)
+}
+
+// SentDirectMessages は送信されたダイレクトメッセージのコピーを返します。
+func (c *FakeTwitterClient) SentDirectMessages() []twitter.DirectMessageEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]twitter.DirectMessageEvent(nil), c.directMessages...)
+}
+
+// SentProfiles は送信されたプロフィールの変更のコピーを返します。
+func (c *FakeTwitterClient) SentProfiles() []twitter.AccountProfileParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]twitter.AccountProfileParams(nil), c.profiles...)
+}
+
+// LookupCalls と ShowCalls は statuses/lookup と statuses/show が呼ばれた回数です。
+func (c *FakeTwitterClient) LookupCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupCalls
+}
+
+func (c *FakeTwitterClient) ShowCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.showCalls
+}
+
+func fakeResponse(code int) *http.Response {
+	return &http.Response{
+		Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode: code,
+		Header:     make(http.Header),
+	}
+}
+
+func fakeAPIError(code int, message string) twitter.APIError {
+	return twitter.APIError{Errors: []twitter.ErrorDetail{{Code: code, Message: message}}}
+}
+
+func (c *FakeTwitterClient) VerifyCredentials() (*twitter.User, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user := c.User
+	return &user, fakeResponse(http.StatusOK), nil
+}
+
+func (c *FakeTwitterClient) LookupTweets(ids []int64, _ *twitter.StatusLookupParams) ([]twitter.Tweet, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lookupCalls++
+
+	if c.lookupErrorCode != 0 {
+		status := http.StatusForbidden
+		if c.lookupErrorCode == 88 { // Rate limit exceeded
+			status = http.StatusTooManyRequests
+		}
+		return nil, fakeResponse(status), fakeAPIError(c.lookupErrorCode, "fake lookup error")
+	}
+
+	tweets := make([]twitter.Tweet, 0, len(ids))
+	for _, id := range ids {
+		if tweet, ok := c.tweets[id]; ok && !c.protected[id] {
+			tweets = append(tweets, tweet)
+		}
+	}
+	return tweets, fakeResponse(http.StatusOK), nil
+}
+
+func (c *FakeTwitterClient) ShowTweet(id int64, _ *twitter.StatusShowParams) (*twitter.Tweet, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.showCalls++
+
+	if c.protected[id] {
+		return nil, fakeResponse(http.StatusForbidden), fakeAPIError(179, "Sorry, you are not authorized to see this status.")
+	}
+	tweet, ok := c.tweets[id]
+	if !ok {
+		return nil, fakeResponse(http.StatusNotFound), fakeAPIError(144, "No status found with that ID.")
+	}
+	return &tweet, fakeResponse(http.StatusOK), nil
+}
+
+func (c *FakeTwitterClient) UpdateStatus(status string, params *twitter.StatusUpdateParams) (*twitter.Tweet, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.statusErrorCode != 0 {
+		return nil, fakeResponse(http.StatusForbidden), fakeAPIError(c.statusErrorCode, "fake status error")
+	}
+
+	user := c.User
+	tweet := twitter.Tweet{
+		ID:   c.nextID,
+		Text: status,
+		User: &user,
+	}
+	if params != nil {
+		tweet.InReplyToStatusID = params.InReplyToStatusID
+	}
+	c.nextID++
+	c.statuses = append(c.statuses, tweet)
+	return &tweet, fakeResponse(http.StatusOK), nil
+}
+
+func (c *FakeTwitterClient) SendDirectMessage(params *twitter.DirectMessageEventsNewParams) (*twitter.DirectMessageEvent, *http.Response, error) {
+	c.mu.Lock()
+	delay := c.directMessageDelay
+	c.mu.Unlock()
+	time.Sleep(delay)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	event := *params.Event
+	event.ID = strconv.FormatInt(c.nextID, 10)
+	c.nextID++
+	c.directMessages = append(c.directMessages, event)
+	return &event, fakeResponse(http.StatusOK), nil
+}
+
+func (c *FakeTwitterClient) UpdateProfile(params *twitter.AccountProfileParams) (*twitter.User, *http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.profiles = append(c.profiles, *params)
+	// Like the real API, empty fields are left as they are.
+	if params.Name != "" {
+		c.User.Name = params.Name
+	}
+	if params.Description != "" {
+		c.User.Description = params.Description
+	}
+	if params.Location != "" {
+		c.User.Location = params.Location
+	}
+	user := c.User
+	return &user, fakeResponse(http.StatusOK), nil
+}
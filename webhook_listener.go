@@ -1,17 +1,185 @@
 package main
 
 import (
-	"log"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"github.com/tomocrafter/go-twitter/twitter"
 )
 
-func listen(payloads chan interface{}) {
+// accountActivityPayload はAccount Activity APIから送られてくるペイロードのうち、Botが処理するイベントです。
+// https://developer.twitter.com/en/docs/accounts-and-users/subscribe-account-activity/guides/account-activity-data-objects
+type accountActivityPayload struct {
+	ForUserID           string                       `json:"for_user_id"`
+	Users               map[string]webhookUser       `json:"users"`
+	TweetCreateEvents   []twitter.TweetCreateEvent   `json:"tweet_create_events"`
+	DirectMessageEvents []twitter.DirectMessageEvent `json:"direct_message_events"`
+}
+
+// webhookUser は direct_message_events と一緒に送られてくる users のユーザーです。
+// ツイートに含まれるユーザーと異なり、IDは文字列で送られてきます。
+type webhookUser struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ScreenName string `json:"screen_name"`
+	Protected  bool   `json:"protected"`
+	Verified   bool   `json:"verified"`
+}
+
+// twitterUsers は users をIDが数値の twitter.User にします。
+func (p accountActivityPayload) twitterUsers() (map[string]twitter.User, error) {
+	users := make(map[string]twitter.User, len(p.Users))
+	for key, u := range p.Users {
+		id, err := strconv.ParseInt(u.ID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		users[key] = twitter.User{
+			ID:         id,
+			IDStr:      u.ID,
+			Name:       u.Name,
+			ScreenName: u.ScreenName,
+			Protected:  u.Protected,
+			Verified:   u.Verified,
+		}
+	}
+	return users, nil
+}
+
+// webhookEvent は payloads に送られるイベントと、そのイベントのIDです。
+type webhookEvent struct {
+	CorrelationID string
+	Event         interface{}
+}
+
+// webhookSignature は body を consumerSecret で署名した X-Twitter-Webhooks-Signature の値を返します。
+func webhookSignature(body []byte, consumerSecret string) string {
+	mac := hmac.New(sha256.New, []byte(consumerSecret))
+	mac.Write(body)
+	return "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookHandler は署名を検証し、ペイロードのイベントを payloads に送るハンドラーを作成します。
+// go-twitter の CreateTwitterAuthHandler と CreateWebhookHandler は正しい署名のリクエストを拒否し、
+// ペイロードのパースにも失敗するため、こちらを利用します。
+func (b *Bot) newWebhookHandler(payloads chan webhookEvent) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		body, err := ioutil.ReadAll(context.Request.Body)
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read the request body."})
+			return
+		}
+
+		signature := context.GetHeader("X-Twitter-Webhooks-Signature")
+		if !hmac.Equal([]byte(signature), []byte(webhookSignature(body, b.Config().Twitter.ConsumerSecret))) {
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "The webhook signature is not correct."})
+			return
+		}
+
+		requestID := newCorrelationID()
+		context.Set("correlation_id", requestID)
+		if logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.WithFields(logrus.Fields{
+				"correlation_id": requestID,
+				"body":           redactWebhookBody(body),
+			}).Debug("webhook payload")
+		}
+
+		var payload accountActivityPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not parse the payload."})
+			return
+		}
+		users, err := payload.twitterUsers()
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not parse the payload."})
+			return
+		}
+
+		if payload.ForUserID != strconv.FormatInt(b.ID, 10) { // Not for this bot
+			context.Status(http.StatusOK)
+			return
+		}
+		countWebhookEvents(body)
+
+		// Give each event its own id, prefixed by the id of the request.
+		count := len(payload.TweetCreateEvents) + len(payload.DirectMessageEvents)
+		n := 0
+		eventID := func() string {
+			n++
+			if count == 1 {
+				return requestID
+			}
+			return requestID + "-" + strconv.Itoa(n)
+		}
+
+		var events []webhookEvent
+		for _, e := range payload.TweetCreateEvents {
+			events = append(events, webhookEvent{CorrelationID: eventID(), Event: e})
+		}
+		for _, e := range payload.DirectMessageEvents {
+			events = append(events, webhookEvent{CorrelationID: eventID(), Event: twitter.DMEvent{
+				DirectMessageEvent: e,
+				Users:              users,
+			}})
+		}
+		for _, e := range events {
+			select {
+			case payloads <- e:
+			case <-b.stopListening:
+				// Twitter retries the delivery if the response is not 2xx.
+				context.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "The bot is shutting down."})
+				return
+			}
+		}
+
+		context.Status(http.StatusOK)
+	}
+}
+
+// countWebhookEvents はペイロードに含まれるイベントの数を種類ごとに数えます。
+// Botが処理しないイベントも、*_events のキーであれば数えます。
+func countWebhookEvents(body []byte) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return
+	}
+	for key, raw := range fields {
+		if !strings.HasSuffix(key, "_events") {
+			continue
+		}
+		var events []json.RawMessage
+		if err := json.Unmarshal(raw, &events); err != nil {
+			continue
+		}
+		webhookEvents.WithLabelValues(strings.TrimSuffix(key, "_events")).Add(float64(len(events)))
+	}
+}
+
+// listen は payloads のイベントを処理し、コマンドを実行します。stopListening が閉じられると戻ります。
+func (b *Bot) listen(payloads chan webhookEvent) {
+	defer close(b.listenDone)
+
 	r := regexp.MustCompile(`<a href=".*?" rel="nofollow">(.*?)</a>`)
-	for event := range payloads {
-		switch t := event.(type) {
+	for {
+		var event webhookEvent
+		select {
+		case <-b.stopListening:
+			return
+		case event = <-payloads:
+		}
+
+		log := logger.WithField("correlation_id", event.CorrelationID)
+		switch t := event.Event.(type) {
 		case twitter.TweetCreateEvent:
 			var builder strings.Builder
 			var isReply bool
@@ -21,7 +189,7 @@ func listen(payloads chan interface{}) {
 			end := -1
 			for i, r := range t.Text {
 				for _, e := range t.Entities.UserMentions {
-					if id == e.ID {
+					if b.ID == e.ID {
 						isReply = true
 					}
 					if i == e.Indices.Start() {
@@ -39,21 +207,28 @@ func listen(payloads chan interface{}) {
 
 			// if not retweet or not replyId or black listed.
 			via := r.FindStringSubmatch(t.Source)
-			if t.RetweetedStatus != nil || !isReply || (len(via) != 0 && isDeniedClient(via[1])) {
-				return
+			if t.RetweetedStatus != nil || !isReply || (len(via) != 0 && b.isDeniedClient(via[1])) {
+				continue
 			}
 
-			log.Println("TL @" + t.User.ScreenName + ": " + t.Text)
+			log = log.WithFields(logrus.Fields{
+				"user_id":     t.User.ID,
+				"screen_name": t.User.ScreenName,
+				"tweet_id":    t.ID,
+			})
+			log.WithField("text", t.Text).Info("mention received")
 
 			body := builder.String()
 
-			tweet := event.(twitter.Tweet)
-			go Dispatch(TimelineSender{
+			tweet := twitter.Tweet(t)
+			b.dispatchAsync(TimelineSender{
+				Bot:   b,
 				Tweet: &tweet,
+				Log:   log,
 			}, body)
 		case twitter.DMEvent:
-			if string(id) == t.Message.SenderID {
-				return
+			if strconv.FormatInt(b.ID, 10) == t.Message.SenderID {
+				continue
 			}
 
 			text := t.Message.Data.Text
@@ -63,9 +238,19 @@ func listen(payloads chan interface{}) {
 
 			user := t.Users[t.Message.SenderID]
 
-			go Dispatch(DirectMessageSender{
+			// The text of direct messages is not logged.
+			log = log.WithFields(logrus.Fields{
+				"user_id":     user.ID,
+				"screen_name": user.ScreenName,
+				"dm_id":       t.ID,
+			})
+			log.Info("direct message received")
+
+			b.dispatchAsync(DirectMessageSender{
+				Bot:                b,
 				User:               &user,
 				DirectMessageEvent: &t.DirectMessageEvent,
+				Log:                log,
 			}, text)
 		}
 	}